@@ -12,8 +12,9 @@ import (
 )
 
 var (
-	storage  = flag.String("storage", "0.0.0.0:8081", "CDC service address")
-	logLevel = flag.String("log-level", "info", "logging level")
+	storage    = flag.String("storage", "0.0.0.0:8081", "CDC service address")
+	logLevel   = flag.String("log-level", "info", "logging level")
+	collection = flag.String("collection", "", "collection to listen, empty means all collections")
 )
 
 func init() {
@@ -56,7 +57,7 @@ func main() {
 
 	client := pbCDC.NewCDCClient(cc)
 
-	stream, err := client.Listen(ctx, &pbCDC.ListenRequest{})
+	stream, err := client.Listen(ctx, &pbCDC.ListenRequest{Collection: *collection})
 	if err != nil {
 		log.Fatal().Caller().Str("storage", *storage).Err(err).Msg("dial failed")
 		return
@@ -68,6 +69,6 @@ func main() {
 			log.Fatal().Caller().Str("storage", *storage).Err(err).Msg("dial failed")
 			return
 		}
-		log.Info().Caller().Str("event", msg.GetEvent().String()).Str("id", msg.GetData().GetId()).Bytes("data", msg.GetData().GetRaw()).Msg("")
+		log.Info().Caller().Str("event", msg.GetEvent().String()).Str("collection", msg.GetCollection()).Str("id", msg.GetData().GetId()).Uint64("version", msg.GetData().GetVersion()).Str("reason", msg.GetReason().String()).Bytes("data", msg.GetData().GetRaw()).Bool("raw_omitted", msg.GetData().GetRawOmitted()).Msg("")
 	}
 }
@@ -0,0 +1,229 @@
+// Command rebalance moves records between storage nodes after list of nodes of web-service is changed.
+// Only records which owner differs by new list of nodes are moved: record is exported with its past versions
+// from old node, imported to new owner and removed from old node. Moved record keeps its version, metadata
+// and history, and no CDC events are published by move. Record which already exists on new owner with
+// the same or greater version is only removed from old node.
+// Run it after web-service is restarted with new list of nodes and previous list of nodes, so records which are
+// not moved yet are read and written on old nodes
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+	"github.com/amasynikov/grpc-webinar/internal/shard"
+)
+
+var (
+	from     = flag.String("from", "", "Comma-separated CRUD-service addresses before change")
+	to       = flag.String("to", "", "Comma-separated CRUD-service addresses after change")
+	dryRun   = flag.Bool("dry-run", false, "Count records to move without moving them")
+	logLevel = flag.String("log-level", "info", "Logging level")
+)
+
+func init() {
+	zerolog.TimeFieldFormat = "2006.01.02-15:04:05.000"
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+}
+
+func nodes(list string) []string {
+	var nodes []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			nodes = append(nodes, address)
+		}
+	}
+	return nodes
+}
+
+func main() {
+	flag.Parse()
+
+	l, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("")
+		return
+	}
+	zerolog.SetGlobalLevel(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := make(map[string]pbCRUD.CRUDClient)
+	admins := make(map[string]pbAdmin.AdminClient)
+	for _, address := range append(nodes(*from), nodes(*to)...) {
+		if _, ok := clients[address]; ok {
+			continue
+		}
+		cc, err := grpc.DialContext(ctx, address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (_ net.Conn, err error) {
+				log.Trace().Str("address", s).Msg("dialing to storage-service")
+				defer func() {
+					if err != nil {
+						log.Error().Caller().Str("address", s).Err(err).Msg("dial to storage-service failed")
+					} else {
+						log.Info().Caller().Str("address", s).Msg("dial to storage-service done")
+					}
+				}()
+				return net.Dial("tcp", s)
+			}),
+		)
+		if err != nil {
+			log.Fatal().Caller().Str("storage", address).Err(err).Msg("dial failed")
+			return
+		}
+		clients[address] = pbCRUD.NewCRUDClient(cc)
+		admins[address] = pbAdmin.NewAdminClient(cc)
+	}
+
+	ring := shard.NewRing(nodes(*to)...)
+	if len(ring.Nodes()) == 0 {
+		log.Fatal().Caller().Msg("no nodes to rebalance to")
+		return
+	}
+
+	total := 0
+	for _, node := range nodes(*from) {
+		moved, err := rebalance(ctx, clients, admins, ring, node)
+		total += moved
+		if err != nil {
+			log.Fatal().Caller().Str("storage", node).Int("moved", total).Err(err).Msg("rebalance failed")
+			return
+		}
+		log.Info().Caller().Str("storage", node).Int("moved", moved).Msg("node rebalanced")
+	}
+	log.Info().Caller().Int("moved", total).Bool("dry-run", *dryRun).Msg("rebalance done")
+}
+
+// rebalance moves records of node which belong to other nodes by ring
+func rebalance(ctx context.Context, clients map[string]pbCRUD.CRUDClient, admins map[string]pbAdmin.AdminClient, ring *shard.Ring, node string) (int, error) {
+	response, err := clients[node].ListCollections(ctx, &pbCRUD.ListCollectionsRequest{})
+	if err != nil {
+		return 0, err
+	}
+	collections := []*pbCRUD.Collection{{}}
+	collections = append(collections, response.GetCollections()...)
+
+	moved := 0
+	for _, collection := range collections {
+		collectionCtx := ctx
+		if collection.GetName() != "" {
+			if !*dryRun {
+				if err := createCollection(ctx, clients, ring, collection); err != nil {
+					return moved, err
+				}
+			}
+			collectionCtx = metadata.AppendToOutgoingContext(ctx, "collection", collection.GetName())
+		}
+		token := ""
+		for {
+			// tombstones are moved too, so deleted records may be undeleted on new owner
+			page, err := clients[node].List(collectionCtx, &pbCRUD.ListRequest{PageToken: token, IncludeDeleted: true})
+			if err != nil {
+				return moved, err
+			}
+			// records of page are moved by one archive per new owner
+			byOwner := make(map[string][]*pbAdmin.RemovedRecord)
+			for _, item := range page.GetItems() {
+				owner := ring.Owner(item.GetId())
+				if owner == node {
+					continue
+				}
+				byOwner[owner] = append(byOwner[owner], &pbAdmin.RemovedRecord{
+					Record:  &pbAdmin.RecordRef{Collection: collection.GetName(), Id: item.GetId()},
+					Version: item.GetVersion(),
+				})
+				log.Debug().Caller().Str("collection", collection.GetName()).Str("id", item.GetId()).Str("from", node).Str("to", owner).Msg("record moved")
+				moved++
+			}
+			if !*dryRun {
+				for owner, records := range byOwner {
+					if err := move(ctx, admins[node], admins[owner], records); err != nil {
+						return moved, err
+					}
+				}
+			}
+			token = page.GetNextPageToken()
+			if token == "" {
+				break
+			}
+		}
+	}
+	return moved, nil
+}
+
+// createCollection creates collection with the same settings on nodes of ring which have no such collection
+func createCollection(ctx context.Context, clients map[string]pbCRUD.CRUDClient, ring *shard.Ring, collection *pbCRUD.Collection) error {
+	for _, node := range ring.Nodes() {
+		_, err := clients[node].CreateCollection(ctx, &pbCRUD.CreateCollectionRequest{Collection: collection})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// move copies records with their past versions from old node to new owner by archive and removes them
+// from old node. Record which is changed on old node after it was listed is kept there
+func move(ctx context.Context, from, to pbAdmin.AdminClient, records []*pbAdmin.RemovedRecord) error {
+	// import is cancelled and not applied if export fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	refs := make([]*pbAdmin.RecordRef, 0, len(records))
+	for _, r := range records {
+		refs = append(refs, r.GetRecord())
+	}
+	export, err := from.Export(ctx, &pbAdmin.ExportRequest{Records: refs})
+	if err != nil {
+		return err
+	}
+	stream, err := to.Import(ctx)
+	if err != nil {
+		return err
+	}
+	// io.EOF of Send means that server closed stream, real error is returned by CloseAndRecv
+	err = stream.Send(&pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Header{Header: &pbAdmin.ImportOptions{Mode: pbAdmin.ImportOptions_Merge}}})
+	for err == nil {
+		response, recvErr := export.Recv()
+		if recvErr == io.EOF {
+			break
+		}
+		if recvErr != nil {
+			return recvErr
+		}
+		err = stream.Send(&pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Chunk{Chunk: response.GetChunk()}})
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	imported, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+
+	removed, err := from.Remove(ctx, &pbAdmin.RemoveRequest{Records: records})
+	if err != nil {
+		return err
+	}
+	if removed.GetSkipped() > 0 {
+		log.Warn().Caller().Uint64("skipped", removed.GetSkipped()).Msg("records changed on old node are kept, run rebalance again")
+	}
+	log.Debug().Caller().Uint64("created", imported.GetCreated()).Uint64("updated", imported.GetUpdated()).Uint64("removed", removed.GetRemoved()).Msg("records moved")
+	return nil
+}
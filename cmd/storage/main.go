@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"github.com/amasynikov/grpc-webinar/internal/storage"
 	"net"
 	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -13,6 +17,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
 	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
 	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
 )
@@ -20,6 +25,40 @@ import (
 var (
 	socket   = flag.String("socket", "tcp://0.0.0.0:8081", "socket of auth service")
 	logLevel = flag.String("log-level", "info", "logging level")
+	backend  = flag.String("backend", "memory", "storage backend: memory, file or wal")
+	dataDir  = flag.String("data-dir", "./data", "directory of durable backends")
+
+	statsInterval = flag.Duration("stats-interval", 0, "period of logging of storage statistics, 0 disables logging")
+
+	lockStripes = flag.Int("lock-stripes", 256, "count of locks which serialize writes of records by hash of id, 1 serializes all writes")
+
+	memoryBudget = flag.Uint64("memory-budget", 0, "max size of values kept in memory by memory backend, least recently used values are evicted to disk, 0 keeps all values in memory")
+	tierDir      = flag.String("tier-dir", "./tier", "directory of spill file of values evicted from memory")
+
+	walSync          = flag.String("wal-sync", string(storage.SyncAlways), "fsync policy of wal backend: always, batch or none")
+	walSyncInterval  = flag.Duration("wal-sync-interval", 100*time.Millisecond, "fsync period of wal backend with batch policy")
+	walSnapshotEvery = flag.Int("wal-snapshot-every", 10000, "count of wal entries between snapshots, 0 disables snapshots")
+
+	idempotencyRetention = flag.Duration("idempotency-retention", 24*time.Hour, "retention period of create idempotency keys")
+	tombstoneRetention   = flag.Duration("tombstone-retention", 24*time.Hour, "retention period of deleted records which may be undeleted, 0 removes records on delete at once")
+	historyDepth         = flag.Int("history-depth", 10, "max count of kept past versions of record, 0 disables history")
+	historyMaxAge        = flag.Duration("history-max-age", 0, "retention period of past versions of record, 0 means no limit")
+
+	compression        = flag.Bool("compression", false, "compress stored values of collections without own compression setting")
+	compressionMinSize = flag.Uint64("compression-min-size", 1024, "min size of compressed value, smaller values are stored as is")
+
+	dedup        = flag.Bool("dedup", false, "store every distinct value once in blob shared by records with same value")
+	dedupMinSize = flag.Uint64("dedup-min-size", 1024, "min size of deduplicated value, smaller values are kept in records")
+
+	encryptionKeyfile = flag.String("encryption-keyfile", "", "JSON file with master keys of encryption of stored values, empty disables encryption")
+
+	leader       = flag.String("leader", "", "address of leader to follow, follower replaces own records by records of leader and rejects writes until promoted")
+	promoteAfter = flag.Duration("promote-after", 0, "period of silence of leader after which follower promotes itself, 0 disables automatic promotion")
+
+	quotaMaxRecords    = flag.Uint64("quota-max-records", 0, "default max count of records per user, 0 means no limit")
+	quotaMaxBytes      = flag.Uint64("quota-max-bytes", 0, "default max total size of records per user, 0 means no limit")
+	quotaMaxObjectSize = flag.Uint64("quota-max-object-size", 0, "default max size of single record, 0 means no limit")
+	quotas             = flag.String("quotas", "", "JSON file with quotas by user which override default quota")
 )
 
 func init() {
@@ -37,6 +76,104 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(l)
 
+	if *memoryBudget > 0 && *backend != "memory" {
+		log.Fatal().Caller().Str("backend", *backend).Msg("memory budget is supported by memory backend only")
+		return
+	}
+
+	var b storage.Backend
+	switch *backend {
+	case "memory":
+		if *memoryBudget == 0 {
+			b = storage.NewMemoryBackend()
+			break
+		}
+		b, err = storage.NewTieredBackend(*tierDir, *memoryBudget)
+		if err != nil {
+			log.Fatal().Caller().Str("tier-dir", *tierDir).Err(err).Msg("")
+			return
+		}
+	case "file":
+		b, err = storage.NewFileBackend(*dataDir)
+		if err != nil {
+			log.Fatal().Caller().Str("data-dir", *dataDir).Err(err).Msg("")
+			return
+		}
+	case "wal":
+		b, err = storage.NewWalBackend(*dataDir, storage.WalOptions{
+			Sync:          storage.SyncPolicy(*walSync),
+			SyncInterval:  *walSyncInterval,
+			SnapshotEvery: *walSnapshotEvery,
+		})
+		if err != nil {
+			log.Fatal().Caller().Str("data-dir", *dataDir).Err(err).Msg("")
+			return
+		}
+	default:
+		log.Fatal().Caller().Str("backend", *backend).Msg("unknown backend")
+		return
+	}
+
+	var userQuotas map[string]storage.Quota
+	if *quotas != "" {
+		content, err := os.ReadFile(*quotas)
+		if err != nil {
+			log.Fatal().Caller().Str("quotas", *quotas).Err(err).Msg("")
+			return
+		}
+		if err := json.Unmarshal(content, &userQuotas); err != nil {
+			log.Fatal().Caller().Str("quotas", *quotas).Err(err).Msg("")
+			return
+		}
+	}
+
+	var keyring *storage.Keyring
+	if *encryptionKeyfile != "" {
+		keyring, err = storage.LoadKeyring(*encryptionKeyfile)
+		if err != nil {
+			log.Fatal().Caller().Str("encryption-keyfile", *encryptionKeyfile).Err(err).Msg("")
+			return
+		}
+	}
+
+	// replication stream carries whole records
+	maxSendMsgSize := grpc.MaxSendMsgSize(storage.MaxReplicationMessageSize)
+
+	storage, err := storage.New(b, storage.Options{
+		IdempotencyRetention: *idempotencyRetention,
+		DefaultQuota: storage.Quota{
+			MaxRecords:    *quotaMaxRecords,
+			MaxBytes:      *quotaMaxBytes,
+			MaxObjectSize: *quotaMaxObjectSize,
+		},
+		Quotas:             userQuotas,
+		TombstoneRetention: *tombstoneRetention,
+		HistoryDepth:       *historyDepth,
+		HistoryMaxAge:      *historyMaxAge,
+		Compression: storage.Compression{
+			Enabled: *compression,
+			MinSize: *compressionMinSize,
+		},
+		Dedup: storage.Dedup{
+			Enabled: *dedup,
+			MinSize: *dedupMinSize,
+		},
+		Keyring:       keyring,
+		Leader:        *leader,
+		PromoteAfter:  *promoteAfter,
+		LockStripes:   *lockStripes,
+		StatsInterval: *statsInterval,
+	})
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("")
+		return
+	}
+	defer func() {
+		if err := storage.Close(); err != nil {
+			log.Error().Caller().Err(err).Msg("close storage failed")
+		}
+	}()
+
 	s := grpc.NewServer(
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
@@ -50,14 +187,16 @@ func main() {
 					}
 					return res, err
 				},
+				storage.UnaryInterceptor,
 			),
 		),
+		grpc.StreamInterceptor(storage.StreamInterceptor),
+		maxSendMsgSize,
 	)
 
-	storage := storage.New()
-
 	pbCRUD.RegisterCRUDServer(s, storage)
 	pbCDC.RegisterCDCServer(s, storage)
+	pbAdmin.RegisterAdminServer(s, storage)
 
 	url, err := url.Parse(*socket)
 	if err != nil {
@@ -70,8 +209,22 @@ func main() {
 		return
 	}
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// CDC and replication streams never end on their own
+		storage.Shutdown()
+		s.GracefulStop()
+		close(stopped)
+	}()
+
 	if err := s.Serve(listen); err != nil {
 		log.Fatal().Caller().Str("socket", *socket).Err(err).Msg("")
 		return
 	}
+	// Serve returns before running requests are done, storage is closed after them
+	<-stopped
 }
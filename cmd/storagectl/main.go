@@ -0,0 +1,203 @@
+// Command storagectl runs admin commands of storage-service:
+//
+//	storagectl [flags] promote             makes follower a leader
+//	storagectl [flags] replication-status  prints replication status
+//	storagectl [flags] backup              writes archive of all records to file
+//	storagectl [flags] restore             restores records from archive file
+//	storagectl [flags] memory-stats        prints usage of memory budget
+//	storagectl [flags] stats               prints statistics of records, operations and CDC
+//	storagectl [flags] dedup-stats         prints deduplication ratio of stored values
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+var (
+	storage  = flag.String("storage", "0.0.0.0:8081", "Admin service address")
+	logLevel = flag.String("log-level", "info", "Logging level")
+
+	file   = flag.String("file", "storage.ndjson", "Archive file of backup and restore")
+	mode   = flag.String("mode", "merge", "Restore mode: merge adds records and replaces older ones, replace makes storage equal to archive")
+	dryRun = flag.Bool("dry-run", false, "Verify archive and count changes of restore without applying them")
+)
+
+// chunkSize is a size of chunk of archive sent on restore
+const chunkSize = 64 << 10
+
+func init() {
+	zerolog.TimeFieldFormat = "2006.01.02-15:04:05.000"
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] promote|replication-status|backup|restore|memory-stats|stats|dedup-stats\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	l, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("")
+		return
+	}
+	zerolog.SetGlobalLevel(l)
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cc, err := grpc.DialContext(ctx, *storage,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, s string) (_ net.Conn, err error) {
+			log.Trace().Str("address", s).Msg("dialing to storage-service")
+			defer func() {
+				if err != nil {
+					log.Error().Caller().Str("address", s).Err(err).Msg("dial to storage-service failed")
+				} else {
+					log.Debug().Caller().Str("address", s).Msg("dial to storage-service done")
+				}
+			}()
+			return net.Dial("tcp", s)
+		}),
+	)
+	if err != nil {
+		log.Fatal().Caller().Str("storage", *storage).Err(err).Msg("dial failed")
+		return
+	}
+
+	client := pbAdmin.NewAdminClient(cc)
+
+	var response proto.Message
+	switch flag.Arg(0) {
+	case "promote":
+		response, err = client.Promote(ctx, &pbAdmin.PromoteRequest{})
+	case "replication-status":
+		response, err = client.ReplicationStatus(ctx, &pbAdmin.ReplicationStatusRequest{})
+	case "backup":
+		err = backup(ctx, client)
+		if err == nil {
+			log.Info().Caller().Str("file", *file).Msg("backup done")
+			return
+		}
+	case "restore":
+		response, err = restore(ctx, client)
+	case "memory-stats":
+		response, err = client.MemoryStats(ctx, &pbAdmin.MemoryStatsRequest{})
+	case "stats":
+		response, err = client.Stats(ctx, &pbAdmin.StatsRequest{})
+	case "dedup-stats":
+		response, err = client.DedupStats(ctx, &pbAdmin.DedupStatsRequest{})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal().Caller().Str("storage", *storage).Str("command", flag.Arg(0)).Err(err).Msg("command failed")
+		return
+	}
+
+	out, err := protojson.MarshalOptions{Multiline: true, EmitUnpopulated: true}.Marshal(response)
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("")
+		return
+	}
+	fmt.Println(string(out))
+}
+
+// backup writes exported archive to temporary file which replaces archive file when export is done
+func backup(ctx context.Context, client pbAdmin.AdminClient) error {
+	stream, err := client.Export(ctx, &pbAdmin.ExportRequest{})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(*file), filepath.Base(*file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(response.GetChunk()); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), *file)
+}
+
+func restore(ctx context.Context, client pbAdmin.AdminClient) (*pbAdmin.ImportResponse, error) {
+	options := &pbAdmin.ImportOptions{DryRun: *dryRun}
+	switch *mode {
+	case "merge":
+		options.Mode = pbAdmin.ImportOptions_Merge
+	case "replace":
+		options.Mode = pbAdmin.ImportOptions_Replace
+	default:
+		return nil, fmt.Errorf("unknown restore mode '%s'", *mode)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stream, err := client.Import(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// io.EOF of Send means that server closed stream, real error is returned by CloseAndRecv
+	err = stream.Send(&pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Header{Header: options}})
+	chunk := make([]byte, chunkSize)
+	for err == nil {
+		n, readErr := f.Read(chunk)
+		if n > 0 {
+			err = stream.Send(&pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Chunk{Chunk: chunk[:n]}})
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
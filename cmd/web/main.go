@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"net"
+	"strings"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -12,11 +13,13 @@ import (
 
 	pbAuth "github.com/amasynikov/grpc-webinar/internal/genproto/auth"
 	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+	"github.com/amasynikov/grpc-webinar/internal/shard"
 	"github.com/amasynikov/grpc-webinar/internal/web"
 )
 
 var (
-	storage  = flag.String("storage", "0.0.0.0:8081", "CRUD-service address")
+	storage  = flag.String("storage", "0.0.0.0:8081", "Comma-separated CRUD-service addresses, records are sharded by id over several nodes")
+	previous = flag.String("previous-storage", "", "Comma-separated CRUD-service addresses before rebalance, records missing on their node are read and written on previous node until rebalance is done")
 	auth     = flag.String("auth", "0.0.0.0:8080", "Auth-service address")
 	logLevel = flag.String("log-level", "info", "Logging level")
 	port     = flag.Int("port", 80, "Web-service port")
@@ -62,29 +65,62 @@ func main() {
 
 	authClient := pbAuth.NewAuthClient(ccAuth)
 
-	ccStorage, err := grpc.DialContext(ctx, *storage,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-		grpc.WithContextDialer(func(ctx context.Context, s string) (_ net.Conn, err error) {
-			log.Trace().Str("address", s).Msg("dialing to storage-service")
-			defer func() {
-				if err != nil {
-					log.Error().Caller().Str("address", s).Err(err).Msg("dial to storage-service failed")
-				} else {
-					log.Info().Caller().Str("address", s).Msg("dial to storage-service done")
-				}
-			}()
-			return net.Dial("tcp", s)
-		}),
-	)
-	if err != nil {
-		log.Fatal().Caller().Str("storage", *storage).Err(err).Msg("dial failed")
-		return
+	// nodes which are in both lists share connection
+	dialed := make(map[string]pbCRUD.CRUDClient)
+	for _, address := range strings.Split(*storage+","+*previous, ",") {
+		address = strings.TrimSpace(address)
+		if _, ok := dialed[address]; ok || address == "" {
+			continue
+		}
+		ccStorage, err := grpc.DialContext(ctx, address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (_ net.Conn, err error) {
+				log.Trace().Str("address", s).Msg("dialing to storage-service")
+				defer func() {
+					if err != nil {
+						log.Error().Caller().Str("address", s).Err(err).Msg("dial to storage-service failed")
+					} else {
+						log.Info().Caller().Str("address", s).Msg("dial to storage-service done")
+					}
+				}()
+				return net.Dial("tcp", s)
+			}),
+		)
+		if err != nil {
+			log.Fatal().Caller().Str("storage", address).Err(err).Msg("dial failed")
+			return
+		}
+		dialed[address] = pbCRUD.NewCRUDClient(ccStorage)
 	}
+	storageClients := clientsOf(dialed, *storage)
+	previousClients := clientsOf(dialed, *previous)
 
-	storageClient := pbCRUD.NewCRUDClient(ccStorage)
+	var storageClient pbCRUD.CRUDClient
+	switch {
+	case len(storageClients) == 0:
+		log.Fatal().Caller().Msg("no storage nodes")
+		return
+	case len(storageClients) == 1 && len(previousClients) == 0:
+		for _, client := range storageClients {
+			storageClient = client
+		}
+	default:
+		storageClient = shard.New(storageClients, previousClients)
+	}
 
 	server := web.New(authClient, storageClient)
 
 	server.Run(ctx, *port)
 }
+
+// clientsOf returns clients of comma-separated addresses
+func clientsOf(dialed map[string]pbCRUD.CRUDClient, list string) map[string]pbCRUD.CRUDClient {
+	clients := make(map[string]pbCRUD.CRUDClient)
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			clients[address] = dialed[address]
+		}
+	}
+	return clients
+}
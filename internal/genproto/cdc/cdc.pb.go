@@ -9,6 +9,7 @@ package cdc
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 )
@@ -25,7 +26,12 @@ type ListenResponse_EventType int32
 const (
 	ListenResponse_Created ListenResponse_EventType = 0
 	ListenResponse_Updated ListenResponse_EventType = 1
+	// record is deleted, tombstone of record is kept during retention period if it is configured
 	ListenResponse_Deleted ListenResponse_EventType = 2
+	// tombstone of deleted record is restored
+	ListenResponse_Undeleted ListenResponse_EventType = 3
+	// tombstone of deleted record is removed permanently by request, retention or expiration
+	ListenResponse_Purged ListenResponse_EventType = 4
 )
 
 // Enum value maps for ListenResponse_EventType.
@@ -34,11 +40,15 @@ var (
 		0: "Created",
 		1: "Updated",
 		2: "Deleted",
+		3: "Undeleted",
+		4: "Purged",
 	}
 	ListenResponse_EventType_value = map[string]int32{
-		"Created": 0,
-		"Updated": 1,
-		"Deleted": 2,
+		"Created":   0,
+		"Updated":   1,
+		"Deleted":   2,
+		"Undeleted": 3,
+		"Purged":    4,
 	}
 )
 
@@ -66,7 +76,140 @@ func (x ListenResponse_EventType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use ListenResponse_EventType.Descriptor instead.
 func (ListenResponse_EventType) EnumDescriptor() ([]byte, []int) {
-	return file_cdc_proto_rawDescGZIP(), []int{2, 0}
+	return file_cdc_proto_rawDescGZIP(), []int{3, 0}
+}
+
+type ListenResponse_EventReason int32
+
+const (
+	// event is a result of CRUD request
+	ListenResponse_Request ListenResponse_EventReason = 0
+	// record is deleted by expiration of time to live
+	ListenResponse_Expired ListenResponse_EventReason = 1
+	// tombstone is purged after retention period
+	ListenResponse_RetentionElapsed ListenResponse_EventReason = 2
+)
+
+// Enum value maps for ListenResponse_EventReason.
+var (
+	ListenResponse_EventReason_name = map[int32]string{
+		0: "Request",
+		1: "Expired",
+		2: "RetentionElapsed",
+	}
+	ListenResponse_EventReason_value = map[string]int32{
+		"Request":          0,
+		"Expired":          1,
+		"RetentionElapsed": 2,
+	}
+)
+
+func (x ListenResponse_EventReason) Enum() *ListenResponse_EventReason {
+	p := new(ListenResponse_EventReason)
+	*p = x
+	return p
+}
+
+func (x ListenResponse_EventReason) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ListenResponse_EventReason) Descriptor() protoreflect.EnumDescriptor {
+	return file_cdc_proto_enumTypes[1].Descriptor()
+}
+
+func (ListenResponse_EventReason) Type() protoreflect.EnumType {
+	return &file_cdc_proto_enumTypes[1]
+}
+
+func (x ListenResponse_EventReason) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ListenResponse_EventReason.Descriptor instead.
+func (ListenResponse_EventReason) EnumDescriptor() ([]byte, []int) {
+	return file_cdc_proto_rawDescGZIP(), []int{3, 1}
+}
+
+type Metadata struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ContentType string                 `protobuf:"bytes,1,opt,name=ContentType,proto3" json:"ContentType,omitempty"`
+	CreatedAt   *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=CreatedAt,proto3" json:"CreatedAt,omitempty"`
+	UpdatedAt   *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=UpdatedAt,proto3" json:"UpdatedAt,omitempty"`
+	// user which created record
+	CreatedBy string `protobuf:"bytes,4,opt,name=CreatedBy,proto3" json:"CreatedBy,omitempty"`
+	// size of raw value in bytes
+	Size uint64 `protobuf:"varint,5,opt,name=Size,proto3" json:"Size,omitempty"`
+}
+
+func (x *Metadata) Reset() {
+	*x = Metadata{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cdc_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Metadata) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Metadata) ProtoMessage() {}
+
+func (x *Metadata) ProtoReflect() protoreflect.Message {
+	mi := &file_cdc_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Metadata.ProtoReflect.Descriptor instead.
+func (*Metadata) Descriptor() ([]byte, []int) {
+	return file_cdc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Metadata) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *Metadata) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Metadata) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+func (x *Metadata) GetCreatedBy() string {
+	if x != nil {
+		return x.CreatedBy
+	}
+	return ""
+}
+
+func (x *Metadata) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
 }
 
 type Data struct {
@@ -74,14 +217,18 @@ type Data struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id  string `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
-	Raw []byte `protobuf:"bytes,2,opt,name=Raw,proto3" json:"Raw,omitempty"`
+	Id       string    `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Raw      []byte    `protobuf:"bytes,2,opt,name=Raw,proto3" json:"Raw,omitempty"`
+	Version  uint64    `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
+	Metadata *Metadata `protobuf:"bytes,4,opt,name=Metadata,proto3" json:"Metadata,omitempty"`
+	// Raw is omitted from events of values larger than 1 MB, such values are read by Read of CRUD
+	RawOmitted bool `protobuf:"varint,5,opt,name=RawOmitted,proto3" json:"RawOmitted,omitempty"`
 }
 
 func (x *Data) Reset() {
 	*x = Data{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_cdc_proto_msgTypes[0]
+		mi := &file_cdc_proto_msgTypes[1]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -94,7 +241,7 @@ func (x *Data) String() string {
 func (*Data) ProtoMessage() {}
 
 func (x *Data) ProtoReflect() protoreflect.Message {
-	mi := &file_cdc_proto_msgTypes[0]
+	mi := &file_cdc_proto_msgTypes[1]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -107,7 +254,7 @@ func (x *Data) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Data.ProtoReflect.Descriptor instead.
 func (*Data) Descriptor() ([]byte, []int) {
-	return file_cdc_proto_rawDescGZIP(), []int{0}
+	return file_cdc_proto_rawDescGZIP(), []int{1}
 }
 
 func (x *Data) GetId() string {
@@ -124,16 +271,40 @@ func (x *Data) GetRaw() []byte {
 	return nil
 }
 
+func (x *Data) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Data) GetMetadata() *Metadata {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (x *Data) GetRawOmitted() bool {
+	if x != nil {
+		return x.RawOmitted
+	}
+	return false
+}
+
 type ListenRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
+
+	// empty means events of all collections
+	Collection string `protobuf:"bytes,1,opt,name=Collection,proto3" json:"Collection,omitempty"`
 }
 
 func (x *ListenRequest) Reset() {
 	*x = ListenRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_cdc_proto_msgTypes[1]
+		mi := &file_cdc_proto_msgTypes[2]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -146,7 +317,7 @@ func (x *ListenRequest) String() string {
 func (*ListenRequest) ProtoMessage() {}
 
 func (x *ListenRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_cdc_proto_msgTypes[1]
+	mi := &file_cdc_proto_msgTypes[2]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -159,7 +330,14 @@ func (x *ListenRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ListenRequest.ProtoReflect.Descriptor instead.
 func (*ListenRequest) Descriptor() ([]byte, []int) {
-	return file_cdc_proto_rawDescGZIP(), []int{1}
+	return file_cdc_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListenRequest) GetCollection() string {
+	if x != nil {
+		return x.Collection
+	}
+	return ""
 }
 
 type ListenResponse struct {
@@ -167,14 +345,17 @@ type ListenResponse struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Event ListenResponse_EventType `protobuf:"varint,1,opt,name=Event,proto3,enum=cdc.ListenResponse_EventType" json:"Event,omitempty"`
-	Data  *Data                    `protobuf:"bytes,2,opt,name=Data,proto3" json:"Data,omitempty"`
+	Event  ListenResponse_EventType   `protobuf:"varint,1,opt,name=Event,proto3,enum=cdc.ListenResponse_EventType" json:"Event,omitempty"`
+	Data   *Data                      `protobuf:"bytes,2,opt,name=Data,proto3" json:"Data,omitempty"`
+	Reason ListenResponse_EventReason `protobuf:"varint,3,opt,name=Reason,proto3,enum=cdc.ListenResponse_EventReason" json:"Reason,omitempty"`
+	// empty for default collection
+	Collection string `protobuf:"bytes,4,opt,name=Collection,proto3" json:"Collection,omitempty"`
 }
 
 func (x *ListenResponse) Reset() {
 	*x = ListenResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_cdc_proto_msgTypes[2]
+		mi := &file_cdc_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -187,7 +368,7 @@ func (x *ListenResponse) String() string {
 func (*ListenResponse) ProtoMessage() {}
 
 func (x *ListenResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_cdc_proto_msgTypes[2]
+	mi := &file_cdc_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -200,7 +381,7 @@ func (x *ListenResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ListenResponse.ProtoReflect.Descriptor instead.
 func (*ListenResponse) Descriptor() ([]byte, []int) {
-	return file_cdc_proto_rawDescGZIP(), []int{2}
+	return file_cdc_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *ListenResponse) GetEvent() ListenResponse_EventType {
@@ -217,29 +398,78 @@ func (x *ListenResponse) GetData() *Data {
 	return nil
 }
 
+func (x *ListenResponse) GetReason() ListenResponse_EventReason {
+	if x != nil {
+		return x.Reason
+	}
+	return ListenResponse_Request
+}
+
+func (x *ListenResponse) GetCollection() string {
+	if x != nil {
+		return x.Collection
+	}
+	return ""
+}
+
 var File_cdc_proto protoreflect.FileDescriptor
 
 var file_cdc_proto_rawDesc = []byte{
 	0x0a, 0x09, 0x63, 0x64, 0x63, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x03, 0x63, 0x64, 0x63,
-	0x22, 0x28, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x49, 0x64, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x52, 0x61, 0x77, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x52, 0x61, 0x77, 0x22, 0x0f, 0x0a, 0x0d, 0x4c, 0x69,
-	0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x98, 0x01, 0x0a, 0x0e,
-	0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33,
-	0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1d, 0x2e,
-	0x63, 0x64, 0x63, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x05, 0x45, 0x76,
-	0x65, 0x6e, 0x74, 0x12, 0x1d, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x09, 0x2e, 0x63, 0x64, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x04, 0x44, 0x61,
-	0x74, 0x61, 0x22, 0x32, 0x0a, 0x09, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12,
-	0x0b, 0x0a, 0x07, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07,
-	0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x44, 0x65, 0x6c,
-	0x65, 0x74, 0x65, 0x64, 0x10, 0x02, 0x32, 0x3c, 0x0a, 0x03, 0x43, 0x44, 0x43, 0x12, 0x35, 0x0a,
-	0x06, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x12, 0x12, 0x2e, 0x63, 0x64, 0x63, 0x2e, 0x4c, 0x69,
-	0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x63, 0x64,
-	0x63, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
-	0x22, 0x00, 0x30, 0x01, 0x42, 0x07, 0x5a, 0x05, 0x2e, 0x2f, 0x63, 0x64, 0x63, 0x62, 0x06, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x22, 0xd2, 0x01, 0x0a, 0x08, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x20,
+	0x0a, 0x0b, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0b, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65,
+	0x12, 0x38, 0x0a, 0x09, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52,
+	0x09, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x38, 0x0a, 0x09, 0x55, 0x70,
+	0x64, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
+	0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x55, 0x70, 0x64, 0x61, 0x74,
+	0x65, 0x64, 0x41, 0x74, 0x12, 0x1c, 0x0a, 0x09, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x42,
+	0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64,
+	0x42, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x22, 0x8d, 0x01, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x12,
+	0x0e, 0x0a, 0x02, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x64, 0x12,
+	0x10, 0x0a, 0x03, 0x52, 0x61, 0x77, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x52, 0x61,
+	0x77, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x29, 0x0a, 0x08, 0x4d,
+	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0d, 0x2e,
+	0x63, 0x64, 0x63, 0x2e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x52, 0x08, 0x4d, 0x65,
+	0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1e, 0x0a, 0x0a, 0x52, 0x61, 0x77, 0x4f, 0x6d, 0x69,
+	0x74, 0x74, 0x65, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x52, 0x61, 0x77, 0x4f,
+	0x6d, 0x69, 0x74, 0x74, 0x65, 0x64, 0x22, 0x2f, 0x0a, 0x0d, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x6f, 0x6c, 0x6c, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x43, 0x6f, 0x6c,
+	0x6c, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0xcb, 0x02, 0x0a, 0x0e, 0x4c, 0x69, 0x73, 0x74,
+	0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33, 0x0a, 0x05, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1d, 0x2e, 0x63, 0x64, 0x63, 0x2e,
+	0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x45,
+	0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12,
+	0x1d, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x09, 0x2e,
+	0x63, 0x64, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x04, 0x44, 0x61, 0x74, 0x61, 0x12, 0x37,
+	0x0a, 0x06, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f,
+	0x2e, 0x63, 0x64, 0x63, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x52,
+	0x06, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x6f, 0x6c, 0x6c, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x43, 0x6f, 0x6c,
+	0x6c, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x4d, 0x0a, 0x09, 0x45, 0x76, 0x65, 0x6e, 0x74,
+	0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x10,
+	0x00, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x10, 0x01, 0x12, 0x0b,
+	0x0a, 0x07, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x10, 0x02, 0x12, 0x0d, 0x0a, 0x09, 0x55,
+	0x6e, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x10, 0x03, 0x12, 0x0a, 0x0a, 0x06, 0x50, 0x75,
+	0x72, 0x67, 0x65, 0x64, 0x10, 0x04, 0x22, 0x3d, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x52,
+	0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x0b, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x45, 0x78, 0x70, 0x69, 0x72, 0x65, 0x64, 0x10, 0x01, 0x12,
+	0x14, 0x0a, 0x10, 0x52, 0x65, 0x74, 0x65, 0x6e, 0x74, 0x69, 0x6f, 0x6e, 0x45, 0x6c, 0x61, 0x70,
+	0x73, 0x65, 0x64, 0x10, 0x02, 0x32, 0x3c, 0x0a, 0x03, 0x43, 0x44, 0x43, 0x12, 0x35, 0x0a, 0x06,
+	0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x12, 0x12, 0x2e, 0x63, 0x64, 0x63, 0x2e, 0x4c, 0x69, 0x73,
+	0x74, 0x65, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x63, 0x64, 0x63,
+	0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x00, 0x30, 0x01, 0x42, 0x07, 0x5a, 0x05, 0x2e, 0x2f, 0x63, 0x64, 0x63, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -254,24 +484,31 @@ func file_cdc_proto_rawDescGZIP() []byte {
 	return file_cdc_proto_rawDescData
 }
 
-var file_cdc_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_cdc_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_cdc_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_cdc_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_cdc_proto_goTypes = []interface{}{
-	(ListenResponse_EventType)(0), // 0: cdc.ListenResponse.EventType
-	(*Data)(nil),                  // 1: cdc.Data
-	(*ListenRequest)(nil),         // 2: cdc.ListenRequest
-	(*ListenResponse)(nil),        // 3: cdc.ListenResponse
+	(ListenResponse_EventType)(0),   // 0: cdc.ListenResponse.EventType
+	(ListenResponse_EventReason)(0), // 1: cdc.ListenResponse.EventReason
+	(*Metadata)(nil),                // 2: cdc.Metadata
+	(*Data)(nil),                    // 3: cdc.Data
+	(*ListenRequest)(nil),           // 4: cdc.ListenRequest
+	(*ListenResponse)(nil),          // 5: cdc.ListenResponse
+	(*timestamppb.Timestamp)(nil),   // 6: google.protobuf.Timestamp
 }
 var file_cdc_proto_depIdxs = []int32{
-	0, // 0: cdc.ListenResponse.Event:type_name -> cdc.ListenResponse.EventType
-	1, // 1: cdc.ListenResponse.Data:type_name -> cdc.Data
-	2, // 2: cdc.CDC.Listen:input_type -> cdc.ListenRequest
-	3, // 3: cdc.CDC.Listen:output_type -> cdc.ListenResponse
-	3, // [3:4] is the sub-list for method output_type
-	2, // [2:3] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	6, // 0: cdc.Metadata.CreatedAt:type_name -> google.protobuf.Timestamp
+	6, // 1: cdc.Metadata.UpdatedAt:type_name -> google.protobuf.Timestamp
+	2, // 2: cdc.Data.Metadata:type_name -> cdc.Metadata
+	0, // 3: cdc.ListenResponse.Event:type_name -> cdc.ListenResponse.EventType
+	3, // 4: cdc.ListenResponse.Data:type_name -> cdc.Data
+	1, // 5: cdc.ListenResponse.Reason:type_name -> cdc.ListenResponse.EventReason
+	4, // 6: cdc.CDC.Listen:input_type -> cdc.ListenRequest
+	5, // 7: cdc.CDC.Listen:output_type -> cdc.ListenResponse
+	7, // [7:8] is the sub-list for method output_type
+	6, // [6:7] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_cdc_proto_init() }
@@ -281,7 +518,7 @@ func file_cdc_proto_init() {
 	}
 	if !protoimpl.UnsafeEnabled {
 		file_cdc_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Data); i {
+			switch v := v.(*Metadata); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -293,7 +530,7 @@ func file_cdc_proto_init() {
 			}
 		}
 		file_cdc_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ListenRequest); i {
+			switch v := v.(*Data); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -305,6 +542,18 @@ func file_cdc_proto_init() {
 			}
 		}
 		file_cdc_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListenRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cdc_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*ListenResponse); i {
 			case 0:
 				return &v.state
@@ -322,8 +571,8 @@ func file_cdc_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_cdc_proto_rawDesc,
-			NumEnums:      1,
-			NumMessages:   3,
+			NumEnums:      2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
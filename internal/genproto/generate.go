@@ -1,3 +1,3 @@
 package genproto
 
-//go:generate protoc --go_out=. --go-grpc_out=. -I../../api ../../api/auth.proto ../../api/crud.proto ../../api/cdc.proto
+//go:generate protoc --go_out=. --go-grpc_out=. -I../../api ../../api/auth.proto ../../api/crud.proto ../../api/cdc.proto ../../api/admin.proto
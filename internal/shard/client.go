@@ -0,0 +1,572 @@
+package shard
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// same page sizes as storage-service uses
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// idempotencyNamespace is a namespace of ids derived from idempotency keys
+var idempotencyNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("github.com/amasynikov/grpc-webinar/shard"))
+
+// shardedClient is a CRUD-client which routes every record to storage node owning its id.
+// Requests without id are sent to all nodes and their results are merged.
+// Quotas and indexes are kept by every node on its own
+type shardedClient struct {
+	ring    *Ring
+	clients map[string]pbCRUD.CRUDClient
+	// nodes before rebalance, record missing on its node is read and written on its previous node until it is moved
+	previous        *Ring
+	previousClients map[string]pbCRUD.CRUDClient
+}
+
+// New makes client of nodes, previous nodes are nodes before rebalance and may be nil
+func New(clients, previous map[string]pbCRUD.CRUDClient) *shardedClient {
+	c := &shardedClient{
+		ring:    NewRing(sortedNodes(clients)...),
+		clients: clients,
+	}
+	if len(previous) > 0 {
+		c.previous = NewRing(sortedNodes(previous)...)
+		c.previousClients = previous
+	}
+	return c
+}
+
+func sortedNodes(clients map[string]pbCRUD.CRUDClient) []string {
+	nodes := make([]string, 0, len(clients))
+	for node := range clients {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (c *shardedClient) owner(id string) pbCRUD.CRUDClient {
+	return c.clients[c.ring.Owner(id)]
+}
+
+// notMoved returns node which owned id before rebalance if record is missing on its node
+// and may be not moved from that node yet
+func (c *shardedClient) notMoved(id string, err error) (pbCRUD.CRUDClient, bool) {
+	if c.previous == nil || status.Code(err) != codes.NotFound {
+		return nil, false
+	}
+	node := c.previous.Owner(id)
+	if node == c.ring.Owner(id) {
+		return nil, false
+	}
+	return c.previousClients[node], true
+}
+
+// holder returns node which keeps record now: previous node of id while record or its tombstone is kept there
+// and is not moved to its node yet, otherwise its node. Writes are sent to holder, so they are not lost
+// by move of older copy of record
+func (c *shardedClient) holder(ctx context.Context, id string) (string, error) {
+	node := c.ring.Owner(id)
+	if c.previous == nil || id == "" {
+		return node, nil
+	}
+	previous := c.previous.Owner(id)
+	if previous == node {
+		return node, nil
+	}
+	if ok, err := kept(ctx, c.clients[node], id); err != nil || ok {
+		return node, err
+	}
+	if ok, err := kept(ctx, c.previousClients[previous], id); err != nil || !ok {
+		return node, err
+	}
+	return previous, nil
+}
+
+// kept is true if node keeps record or its tombstone
+func kept(ctx context.Context, client pbCRUD.CRUDClient, id string) (bool, error) {
+	_, err := client.ListVersions(ctx, &pbCRUD.ListVersionsRequest{Id: id})
+	switch status.Code(err) {
+	case codes.OK:
+		return true, nil
+	case codes.NotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// holderClient returns client of holder of record
+func (c *shardedClient) holderClient(ctx context.Context, id string) (pbCRUD.CRUDClient, error) {
+	node, err := c.holder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if client, ok := c.clients[node]; ok {
+		return client, nil
+	}
+	return c.previousClients[node], nil
+}
+
+// broadcast calls f for every node concurrently and returns first error
+func (c *shardedClient) broadcast(f func(i int, client pbCRUD.CRUDClient) error) error {
+	errs := make([]error, len(c.ring.Nodes()))
+	var wg sync.WaitGroup
+	for i, node := range c.ring.Nodes() {
+		wg.Add(1)
+		go func(i int, client pbCRUD.CRUDClient) {
+			defer wg.Done()
+			errs[i] = f(i, client)
+		}(i, c.clients[node])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastDDL calls f for every node and ignores error with code unless all nodes return it,
+// so repeated request completes change which was applied to some nodes only
+func (c *shardedClient) broadcastDDL(code codes.Code, f func(client pbCRUD.CRUDClient) error) error {
+	errs := make([]error, len(c.ring.Nodes()))
+	c.broadcast(func(i int, client pbCRUD.CRUDClient) error {
+		errs[i] = f(client)
+		return nil
+	})
+	ignored := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case status.Code(err) == code:
+			ignored++
+		default:
+			return err
+		}
+	}
+	if ignored == len(errs) && ignored > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// newID returns id of new record owned by node, empty node means any node.
+// Id of request with idempotency key is derived from the key, so retries reach the same node
+func (c *shardedClient) newID(ctx context.Context, idempotencyKey, node string) (string, error) {
+	if idempotencyKey != "" {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		name := ""
+		for _, key := range []string{"user", "collection"} {
+			if values := md.Get(key); len(values) > 0 {
+				name += values[0]
+			}
+			name += "\x00"
+		}
+		id := uuid.NewSHA1(idempotencyNamespace, []byte(name+idempotencyKey)).String()
+		if node == "" || c.ring.Owner(id) == node {
+			return id, nil
+		}
+	}
+	for {
+		id, err := uuid.NewUUID()
+		if err != nil {
+			return "", status.Errorf(codes.Internal, err.Error())
+		}
+		if node == "" || c.ring.Owner(id.String()) == node {
+			return id.String(), nil
+		}
+	}
+}
+
+// assignID sets id of create request without id
+func (c *shardedClient) assignID(ctx context.Context, request *pbCRUD.CreateRequest, node string) error {
+	if request.GetId() != "" {
+		return nil
+	}
+	id, err := c.newID(ctx, request.GetIdempotencyKey(), node)
+	if err != nil {
+		return err
+	}
+	request.Id = id
+	return nil
+}
+
+func (c *shardedClient) Create(ctx context.Context, in *pbCRUD.CreateRequest, opts ...grpc.CallOption) (*pbCRUD.CreateResponse, error) {
+	if err := c.assignID(ctx, in, ""); err != nil {
+		return nil, err
+	}
+	// record with the same id may be kept by previous node yet
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Create(ctx, in, opts...)
+}
+
+func (c *shardedClient) Read(ctx context.Context, in *pbCRUD.ReadRequest, opts ...grpc.CallOption) (*pbCRUD.ReadResponse, error) {
+	response, err := c.owner(in.GetId()).Read(ctx, in, opts...)
+	if previous, ok := c.notMoved(in.GetId(), err); ok {
+		return previous.Read(ctx, in, opts...)
+	}
+	return response, err
+}
+
+func (c *shardedClient) Update(ctx context.Context, in *pbCRUD.UpdateRequest, opts ...grpc.CallOption) (*pbCRUD.UpdateResponse, error) {
+	client, err := c.holderClient(ctx, in.GetData().GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Update(ctx, in, opts...)
+}
+
+func (c *shardedClient) Patch(ctx context.Context, in *pbCRUD.PatchRequest, opts ...grpc.CallOption) (*pbCRUD.PatchResponse, error) {
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Patch(ctx, in, opts...)
+}
+
+func (c *shardedClient) Delete(ctx context.Context, in *pbCRUD.DeleteRequest, opts ...grpc.CallOption) (*pbCRUD.DeleteResponse, error) {
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Delete(ctx, in, opts...)
+}
+
+func (c *shardedClient) Upsert(ctx context.Context, in *pbCRUD.UpsertRequest, opts ...grpc.CallOption) (*pbCRUD.UpsertResponse, error) {
+	client, err := c.holderClient(ctx, in.GetData().GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Upsert(ctx, in, opts...)
+}
+
+func (c *shardedClient) Undelete(ctx context.Context, in *pbCRUD.UndeleteRequest, opts ...grpc.CallOption) (*pbCRUD.UndeleteResponse, error) {
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Undelete(ctx, in, opts...)
+}
+
+func (c *shardedClient) Purge(ctx context.Context, in *pbCRUD.PurgeRequest, opts ...grpc.CallOption) (*pbCRUD.PurgeResponse, error) {
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Purge(ctx, in, opts...)
+}
+
+func (c *shardedClient) ListVersions(ctx context.Context, in *pbCRUD.ListVersionsRequest, opts ...grpc.CallOption) (*pbCRUD.ListVersionsResponse, error) {
+	response, err := c.owner(in.GetId()).ListVersions(ctx, in, opts...)
+	if previous, ok := c.notMoved(in.GetId(), err); ok {
+		return previous.ListVersions(ctx, in, opts...)
+	}
+	return response, err
+}
+
+func (c *shardedClient) ReadVersion(ctx context.Context, in *pbCRUD.ReadVersionRequest, opts ...grpc.CallOption) (*pbCRUD.ReadResponse, error) {
+	response, err := c.owner(in.GetId()).ReadVersion(ctx, in, opts...)
+	if previous, ok := c.notMoved(in.GetId(), err); ok {
+		return previous.ReadVersion(ctx, in, opts...)
+	}
+	return response, err
+}
+
+func (c *shardedClient) Download(ctx context.Context, in *pbCRUD.DownloadRequest, opts ...grpc.CallOption) (pbCRUD.CRUD_DownloadClient, error) {
+	client, err := c.holderClient(ctx, in.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return client.Download(ctx, in, opts...)
+}
+
+// Batch is atomic within single node only, so all records of batch must belong to the same node.
+// Records created without id get ids owned by that node. Batch of records which are not moved
+// to that node yet is refused until they are moved
+func (c *shardedClient) Batch(ctx context.Context, in *pbCRUD.BatchRequest, opts ...grpc.CallOption) (*pbCRUD.BatchResponse, error) {
+	node := ""
+	for i, op := range in.GetOperations() {
+		id := ""
+		switch op := op.GetOp().(type) {
+		case *pbCRUD.Operation_Create:
+			id = op.Create.GetId()
+		case *pbCRUD.Operation_Update:
+			id = op.Update.GetData().GetId()
+		case *pbCRUD.Operation_Delete:
+			id = op.Delete.GetId()
+		case *pbCRUD.Operation_Upsert:
+			id = op.Upsert.GetData().GetId()
+		}
+		if id == "" {
+			continue
+		}
+		owner := c.ring.Owner(id)
+		if node != "" && owner != node {
+			return nil, status.Errorf(codes.InvalidArgument, "operation %d: record '%s' belongs to another shard than previous records of batch", i, id)
+		}
+		node = owner
+		holder, err := c.holder(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if holder != owner {
+			return nil, status.Errorf(codes.Unavailable, "operation %d: record '%s' is being moved to another shard", i, id)
+		}
+	}
+	for _, op := range in.GetOperations() {
+		if create := op.GetCreate(); create != nil {
+			if err := c.assignID(ctx, create, node); err != nil {
+				return nil, err
+			}
+			node = c.ring.Owner(create.GetId())
+		}
+	}
+	if node == "" {
+		node = c.ring.Nodes()[0]
+	}
+	return c.clients[node].Batch(ctx, in, opts...)
+}
+
+// mergePages merges pages of records sorted by id from all nodes into single page
+func mergePages(pages [][]*pbCRUD.Data, more bool, requested uint32) ([]*pbCRUD.Data, string) {
+	limit := int(requested)
+	switch {
+	case limit == 0:
+		limit = defaultPageSize
+	case limit > maxPageSize:
+		limit = maxPageSize
+	}
+	var items []*pbCRUD.Data
+	for _, page := range pages {
+		items = append(items, page...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].GetId() < items[j].GetId() })
+	if len(items) > limit {
+		items, more = items[:limit], true
+	}
+	if !more || len(items) == 0 {
+		return items, ""
+	}
+	return items, base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].GetId()))
+}
+
+func (c *shardedClient) List(ctx context.Context, in *pbCRUD.ListRequest, opts ...grpc.CallOption) (*pbCRUD.ListResponse, error) {
+	pages := make([][]*pbCRUD.Data, len(c.ring.Nodes()))
+	more := make([]bool, len(c.ring.Nodes()))
+	err := c.broadcast(func(i int, client pbCRUD.CRUDClient) error {
+		response, err := client.List(ctx, in, opts...)
+		if err != nil {
+			return err
+		}
+		pages[i], more[i] = response.GetItems(), response.GetNextPageToken() != ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	items, next := mergePages(pages, anyOf(more), in.GetPageSize())
+	return &pbCRUD.ListResponse{Items: items, NextPageToken: next}, nil
+}
+
+func (c *shardedClient) Query(ctx context.Context, in *pbCRUD.QueryRequest, opts ...grpc.CallOption) (*pbCRUD.QueryResponse, error) {
+	pages := make([][]*pbCRUD.Data, len(c.ring.Nodes()))
+	more := make([]bool, len(c.ring.Nodes()))
+	err := c.broadcast(func(i int, client pbCRUD.CRUDClient) error {
+		response, err := client.Query(ctx, in, opts...)
+		if err != nil {
+			return err
+		}
+		pages[i], more[i] = response.GetItems(), response.GetNextPageToken() != ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	items, next := mergePages(pages, anyOf(more), in.GetPageSize())
+	return &pbCRUD.QueryResponse{Items: items, NextPageToken: next}, nil
+}
+
+func anyOf(values []bool) bool {
+	for _, v := range values {
+		if v {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *shardedClient) GetUsage(ctx context.Context, in *pbCRUD.GetUsageRequest, opts ...grpc.CallOption) (*pbCRUD.GetUsageResponse, error) {
+	responses := make([]*pbCRUD.GetUsageResponse, len(c.ring.Nodes()))
+	err := c.broadcast(func(i int, client pbCRUD.CRUDClient) (err error) {
+		responses[i], err = client.GetUsage(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// quotas are enforced by every node on its own, so limits of first node are reported
+	usage := &pbCRUD.GetUsageResponse{
+		User:          responses[0].GetUser(),
+		MaxRecords:    responses[0].GetMaxRecords(),
+		MaxBytes:      responses[0].GetMaxBytes(),
+		MaxObjectSize: responses[0].GetMaxObjectSize(),
+	}
+	for _, response := range responses {
+		usage.Records += response.GetRecords()
+		usage.Bytes += response.GetBytes()
+	}
+	return usage, nil
+}
+
+func (c *shardedClient) CreateIndex(ctx context.Context, in *pbCRUD.CreateIndexRequest, opts ...grpc.CallOption) (*pbCRUD.CreateIndexResponse, error) {
+	err := c.broadcastDDL(codes.AlreadyExists, func(client pbCRUD.CRUDClient) error {
+		_, err := client.CreateIndex(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pbCRUD.CreateIndexResponse{}, nil
+}
+
+func (c *shardedClient) DropIndex(ctx context.Context, in *pbCRUD.DropIndexRequest, opts ...grpc.CallOption) (*pbCRUD.DropIndexResponse, error) {
+	err := c.broadcastDDL(codes.NotFound, func(client pbCRUD.CRUDClient) error {
+		_, err := client.DropIndex(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pbCRUD.DropIndexResponse{}, nil
+}
+
+func (c *shardedClient) ListIndexes(ctx context.Context, in *pbCRUD.ListIndexesRequest, opts ...grpc.CallOption) (*pbCRUD.ListIndexesResponse, error) {
+	return c.clients[c.ring.Nodes()[0]].ListIndexes(ctx, in, opts...)
+}
+
+func (c *shardedClient) CreateCollection(ctx context.Context, in *pbCRUD.CreateCollectionRequest, opts ...grpc.CallOption) (*pbCRUD.CreateCollectionResponse, error) {
+	err := c.broadcastDDL(codes.AlreadyExists, func(client pbCRUD.CRUDClient) error {
+		_, err := client.CreateCollection(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pbCRUD.CreateCollectionResponse{}, nil
+}
+
+func (c *shardedClient) DropCollection(ctx context.Context, in *pbCRUD.DropCollectionRequest, opts ...grpc.CallOption) (*pbCRUD.DropCollectionResponse, error) {
+	err := c.broadcastDDL(codes.NotFound, func(client pbCRUD.CRUDClient) error {
+		_, err := client.DropCollection(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pbCRUD.DropCollectionResponse{}, nil
+}
+
+// SetSchema sets schema on every node, repeated request completes change which failed on some nodes
+func (c *shardedClient) SetSchema(ctx context.Context, in *pbCRUD.SetSchemaRequest, opts ...grpc.CallOption) (*pbCRUD.SetSchemaResponse, error) {
+	err := c.broadcast(func(i int, client pbCRUD.CRUDClient) error {
+		_, err := client.SetSchema(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pbCRUD.SetSchemaResponse{}, nil
+}
+
+// ListCollections returns settings of collections from first node and usage of collections summed over all nodes
+func (c *shardedClient) ListCollections(ctx context.Context, in *pbCRUD.ListCollectionsRequest, opts ...grpc.CallOption) (*pbCRUD.ListCollectionsResponse, error) {
+	responses := make([]*pbCRUD.ListCollectionsResponse, len(c.ring.Nodes()))
+	err := c.broadcast(func(i int, client pbCRUD.CRUDClient) (err error) {
+		responses[i], err = client.ListCollections(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	collections := responses[0].GetCollections()
+	byName := make(map[string]*pbCRUD.Collection, len(collections))
+	for _, collection := range collections {
+		byName[collection.GetName()] = collection
+	}
+	for _, response := range responses[1:] {
+		for _, collection := range response.GetCollections() {
+			if total, ok := byName[collection.GetName()]; ok {
+				total.Records += collection.GetRecords()
+				total.Bytes += collection.GetBytes()
+			}
+		}
+	}
+	return &pbCRUD.ListCollectionsResponse{Collections: collections}, nil
+}
+
+// Upload opens stream to node owning record on first message of stream which is a header
+func (c *shardedClient) Upload(ctx context.Context, opts ...grpc.CallOption) (pbCRUD.CRUD_UploadClient, error) {
+	return &uploadClient{c: c, ctx: ctx, opts: opts}, nil
+}
+
+type uploadClient struct {
+	// CRUD_UploadClient is a stream to owning node, nil until header is sent
+	pbCRUD.CRUD_UploadClient
+
+	c    *shardedClient
+	ctx  context.Context
+	opts []grpc.CallOption
+}
+
+func (u *uploadClient) Send(request *pbCRUD.UploadRequest) error {
+	if u.CRUD_UploadClient == nil {
+		header := request.GetHeader()
+		if header == nil {
+			return status.Errorf(codes.InvalidArgument, "first message of upload is not a header")
+		}
+		if err := u.c.assignID(u.ctx, header, ""); err != nil {
+			return err
+		}
+		client, err := u.c.holderClient(u.ctx, header.GetId())
+		if err != nil {
+			return err
+		}
+		stream, err := client.Upload(u.ctx, u.opts...)
+		if err != nil {
+			return err
+		}
+		u.CRUD_UploadClient = stream
+	}
+	return u.CRUD_UploadClient.Send(request)
+}
+
+func (u *uploadClient) CloseAndRecv() (*pbCRUD.CreateResponse, error) {
+	if u.CRUD_UploadClient == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "upload without header")
+	}
+	return u.CRUD_UploadClient.CloseAndRecv()
+}
+
+func (u *uploadClient) Context() context.Context {
+	if u.CRUD_UploadClient == nil {
+		return u.ctx
+	}
+	return u.CRUD_UploadClient.Context()
+}
@@ -0,0 +1,72 @@
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is a number of points of every node on ring
+const virtualNodes = 128
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring is a consistent hash ring of storage nodes. Record belongs to node owning first point after hash of its id,
+// so adding or removing node moves only records of points taken or released by that node
+type Ring struct {
+	nodes  []string
+	points []point
+}
+
+func NewRing(nodes ...string) *Ring {
+	r := &Ring{
+		nodes:  append([]string(nil), nodes...),
+		points: make([]point, 0, len(nodes)*virtualNodes),
+	}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV spreads similar strings like addresses of nodes poorly, so its sum is mixed by finalizer of MurmurHash3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Nodes returns nodes of ring in order they were given
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Owner returns node which owns record with id, empty ring owns nothing
+func (r *Ring) Owner(id string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+const (
+	archiveFormat  = "grpc-webinar-storage"
+	archiveVersion = 1
+	// exportChunkSize is a max size of chunk of exported archive
+	exportChunkSize = 64 << 10
+	// archiveBatchSize and archiveBatchBytes limit count and size of records which are imported under one lock
+	// of dataMtx and are exported under one lock of their stripes
+	archiveBatchSize  = 1000
+	archiveBatchBytes = 4 << 20
+)
+
+// Archive is NDJSON: header line, line per record and trailer line with count of records
+// and SHA-256 of all previous lines
+type archiveHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// Sequence is a number of last write before export, records are read by batches, so later writes may be included
+	Sequence uint64 `json:"sequence"`
+}
+
+type archiveEntry struct {
+	// Key of record in backend
+	Key    string  `json:"key"`
+	Record *Record `json:"record"`
+}
+
+type archiveTrailer struct {
+	Records uint64 `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+type archiveWriter struct {
+	w       io.Writer
+	sum     hash.Hash
+	records uint64
+}
+
+func newArchiveWriter(w io.Writer, header archiveHeader) (*archiveWriter, error) {
+	a := &archiveWriter{w: w, sum: sha256.New()}
+	return a, a.writeLine(header, true)
+}
+
+func (a *archiveWriter) writeLine(v interface{}, summed bool) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if summed {
+		a.sum.Write(line)
+	}
+	_, err = a.w.Write(line)
+	return err
+}
+
+func (a *archiveWriter) write(key string, r *Record) error {
+	a.records++
+	return a.writeLine(archiveEntry{Key: key, Record: r}, true)
+}
+
+func (a *archiveWriter) close() error {
+	return a.writeLine(archiveTrailer{Records: a.records, SHA256: hex.EncodeToString(a.sum.Sum(nil))}, false)
+}
+
+// readArchive reads and verifies whole archive, f is called for every entry unless it is nil.
+// Entries are passed before checksum is verified, so archive is read twice to apply verified entries
+func readArchive(r io.Reader, f func(entry archiveEntry) error) (archiveHeader, uint64, error) {
+	var (
+		header  archiveHeader
+		records uint64
+		trailer *archiveTrailer
+	)
+	sum := sha256.New()
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return header, 0, err
+		}
+		if trailer != nil {
+			return header, 0, fmt.Errorf("line %d: data after trailer", n)
+		}
+		switch {
+		case n == 1:
+			if err := json.Unmarshal(line, &header); err != nil {
+				return header, 0, fmt.Errorf("line %d: %w", n, err)
+			}
+			if header.Format != archiveFormat {
+				return header, 0, fmt.Errorf("unknown archive format '%s'", header.Format)
+			}
+			if header.Version != archiveVersion {
+				return header, 0, fmt.Errorf("unsupported archive version %d", header.Version)
+			}
+		case bytes.HasPrefix(line, []byte(`{"records":`)):
+			trailer = &archiveTrailer{}
+			if err := json.Unmarshal(line, trailer); err != nil {
+				return header, 0, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		default:
+			var entry archiveEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return header, 0, fmt.Errorf("line %d: %w", n, err)
+			}
+			if err := entry.check(); err != nil {
+				return header, 0, fmt.Errorf("line %d: %w", n, err)
+			}
+			records++
+			if f != nil {
+				if err := f(entry); err != nil {
+					return header, 0, err
+				}
+			}
+		}
+		sum.Write(line)
+	}
+	switch {
+	case trailer == nil:
+		return header, 0, fmt.Errorf("archive is truncated")
+	case trailer.Records != records:
+		return header, 0, fmt.Errorf("archive has %d records, trailer expects %d", records, trailer.Records)
+	case trailer.SHA256 != hex.EncodeToString(sum.Sum(nil)):
+		return header, 0, fmt.Errorf("checksum mismatch")
+	}
+	return header, records, nil
+}
+
+// check validates entry of archive. Records outside of backend keep their values, so encoded records
+// and references of blobs are rejected
+func (e archiveEntry) check() error {
+	switch {
+	case e.Key == "" || e.Record == nil:
+		return errors.New("empty record")
+	case isBlobID(e.Key):
+		return fmt.Errorf("key '%s' is reserved for blobs", e.Key)
+	case e.Record.Encoding != "" || e.Record.KeyID != "" || len(e.Record.DataKey) > 0 || e.Record.Blob != "":
+		return fmt.Errorf("record '%s' is encoded", e.Key)
+	}
+	return nil
+}
+
+// chunkWriter sends written bytes as chunks of export stream
+type chunkWriter struct {
+	stream pbAdmin.Admin_ExportServer
+}
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&pbAdmin.ExportResponse{Chunk: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *storageServer) Export(request *pbAdmin.ExportRequest, stream pbAdmin.Admin_ExportServer) (err error) {
+	log.Info().Caller().Msg("export")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("export failed")
+		} else {
+			log.Info().Caller().Msg("export done")
+		}
+	}()
+
+	c.commitMtx.Lock()
+	sequence := c.sequence
+	c.commitMtx.Unlock()
+	keys, err := c.exportedKeys(request.GetRecords())
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(chunkWriter{stream: stream}, exportChunkSize)
+	a, err := newArchiveWriter(w, archiveHeader{
+		Format:    archiveFormat,
+		Version:   archiveVersion,
+		CreatedAt: time.Now().UTC(),
+		Sequence:  sequence,
+	})
+	if err != nil {
+		return err
+	}
+	// records are read by batches and locks are released before batch is sent, so slow client does not block writes
+	for len(keys) > 0 {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		entries, n, err := c.exportBatch(keys)
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+		for _, e := range entries {
+			if err := a.write(e.Key, e.Record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := a.close(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// exportedKeys returns sorted backend keys of requested records, all records and system records if none is requested.
+// Keys of past versions are not listed, they are exported with their records
+func (c *storageServer) exportedKeys(requested []*pbAdmin.RecordRef) ([]string, error) {
+	var keys []string
+	if len(requested) > 0 {
+		unique := make(map[string]struct{}, len(requested))
+		for _, ref := range requested {
+			key := recordKey(ref.GetCollection(), ref.GetId())
+			if _, ok := unique[key]; !ok {
+				unique[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	} else {
+		c.dataMtx.RLock()
+		all, err := c.data.Keys()
+		c.dataMtx.RUnlock()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		for _, key := range all {
+			if _, ok := historyOwner(key); !ok && portable(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// exportBatch reads records by backend keys with their past versions under locks of their stripes until batch is full,
+// so record is consistent with its history. It returns entries of batch and count of consumed keys
+func (c *storageServer) exportBatch(keys []string) ([]archiveEntry, int, error) {
+	if len(keys) > archiveBatchSize {
+		keys = keys[:archiveBatchSize]
+	}
+	ids := make([]int, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, c.stripes.of(key))
+	}
+
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+	locks := c.stripes.lockAll(ids)
+	defer locks.unlock()
+
+	var entries []archiveEntry
+	size := 0
+	for n, key := range keys {
+		if size >= archiveBatchBytes {
+			return entries, n, nil
+		}
+		r, ok, err := c.data.Get(key)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, err.Error())
+		}
+		if !ok {
+			continue
+		}
+		entries = append(entries, archiveEntry{Key: key, Record: r})
+		size += len(r.Raw)
+
+		hr, h, err := c.loadHistory(key)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, err.Error())
+		}
+		if hr == nil {
+			continue
+		}
+		entries = append(entries, archiveEntry{Key: historyIDPrefix + key, Record: hr})
+		for _, v := range h {
+			id := versionID(key, v.Version)
+			vr, ok, err := c.data.Get(id)
+			if err != nil {
+				return nil, 0, status.Errorf(codes.Internal, err.Error())
+			}
+			if ok {
+				entries = append(entries, archiveEntry{Key: id, Record: vr})
+				size += len(vr.Raw)
+			}
+		}
+	}
+	return entries, len(keys), nil
+}
+
+// importReader reads chunks of import stream
+type importReader struct {
+	stream pbAdmin.Admin_ImportServer
+	chunk  []byte
+}
+
+func (r *importReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		request, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if request.GetHeader() != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "header in the middle of import")
+		}
+		r.chunk = request.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (c *storageServer) Import(stream pbAdmin.Admin_ImportServer) (err error) {
+	log.Info().Caller().Msg("import")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("import failed")
+		} else {
+			log.Info().Caller().Msg("import done")
+		}
+	}()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	options := first.GetHeader()
+	if options == nil {
+		return status.Errorf(codes.InvalidArgument, "first message of import is not a header")
+	}
+
+	// archive is spooled to temporary file and verified before it is applied, so memory does not grow with archive
+	file, err := os.CreateTemp("", "import-*.ndjson")
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	if _, err := io.Copy(file, &importReader{stream: stream}); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	header, records, err := readArchive(file, nil)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "wrong archive: %s", err.Error())
+	}
+	log.Info().Caller().Time("created_at", header.CreatedAt).Uint64("sequence", header.Sequence).Uint64("records", records).Msg("archive verified")
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	response, err := c.restore(options, file)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(response)
+}
+
+// restore applies records of verified archive by batches, each batch is applied under its own lock of dataMtx.
+// Quotas are not checked and CDC events are not published
+func (c *storageServer) restore(options *pbAdmin.ImportOptions, archive io.Reader) (*pbAdmin.ImportResponse, error) {
+	response := &pbAdmin.ImportResponse{DryRun: options.GetDryRun()}
+	archived := make(map[string]struct{})
+	var (
+		batch []archiveEntry
+		size  uint64
+	)
+	flush := func() error {
+		err := c.restoreBatch(options, batch, response)
+		batch, size = batch[:0], 0
+		return err
+	}
+	_, records, err := readArchive(archive, func(entry archiveEntry) error {
+		if !portable(entry.Key) {
+			return nil
+		}
+		archived[entry.Key] = struct{}{}
+		batch = append(batch, entry)
+		size += entry.Record.Size
+		if len(batch) < archiveBatchSize && size < archiveBatchBytes {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	response.Records = records
+
+	if options.GetMode() == pbAdmin.ImportOptions_Replace {
+		if err := c.removeMissing(options, archived, response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// restoreBatch applies records of archive and counts them in response
+func (c *storageServer) restoreBatch(options *pbAdmin.ImportOptions, entries []archiveEntry, response *pbAdmin.ImportResponse) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	if c.leader != "" && !options.GetDryRun() {
+		return c.notLeaderError()
+	}
+
+	mutations := make([]Mutation, 0, len(entries))
+	for _, entry := range entries {
+		old, ok, err := c.data.Get(entry.Key)
+		if err != nil {
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		switch {
+		case !ok:
+			response.Created++
+		case options.GetMode() == pbAdmin.ImportOptions_Merge && old.Version >= entry.Record.Version:
+			response.Skipped++
+			continue
+		default:
+			response.Updated++
+		}
+		mutations = append(mutations, Mutation{ID: entry.Key, Record: entry.Record})
+	}
+	if options.GetDryRun() {
+		return nil
+	}
+	return c.applyMutations(mutations)
+}
+
+// removeMissing removes stored records which are missing in archive by batches under one lock of dataMtx,
+// so records created during removal are not removed
+func (c *storageServer) removeMissing(options *pbAdmin.ImportOptions, archived map[string]struct{}, response *pbAdmin.ImportResponse) error {
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	if c.leader != "" && !options.GetDryRun() {
+		return c.notLeaderError()
+	}
+
+	keys, err := c.data.Keys()
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	mutations := make([]Mutation, 0, archiveBatchSize)
+	for _, key := range keys {
+		if _, ok := archived[key]; ok || !portable(key) {
+			continue
+		}
+		response.Removed++
+		if options.GetDryRun() {
+			continue
+		}
+		mutations = append(mutations, Mutation{ID: key})
+		if len(mutations) == archiveBatchSize {
+			if err := c.applyMutations(mutations); err != nil {
+				return err
+			}
+			mutations = mutations[:0]
+		}
+	}
+	return c.applyMutations(mutations)
+}
+
+// applyMutations applies mutations of import or removal without CDC events and replicates them.
+// Caller holds dataMtx for writing
+func (c *storageServer) applyMutations(mutations []Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	if err := c.applyRecords(mutations); err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	c.commitMtx.Lock()
+	defer c.commitMtx.Unlock()
+
+	c.sequence++
+	c.replicate(mutations, nil)
+	return nil
+}
+
+func (c *storageServer) Remove(ctx context.Context, request *pbAdmin.RemoveRequest) (_ *pbAdmin.RemoveResponse, err error) {
+	log.Info().Caller().Int("records", len(request.GetRecords())).Msg("remove")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("remove failed")
+		} else {
+			log.Info().Caller().Msg("remove done")
+		}
+	}()
+
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	if c.leader != "" {
+		return nil, c.notLeaderError()
+	}
+
+	response := &pbAdmin.RemoveResponse{}
+	removed := make(map[string]struct{}, len(request.GetRecords()))
+	var mutations []Mutation
+	for _, removal := range request.GetRecords() {
+		key := recordKey(removal.GetRecord().GetCollection(), removal.GetRecord().GetId())
+		if isSystemID(key) {
+			return nil, status.Errorf(codes.InvalidArgument, "id '%s' is reserved", removal.GetRecord().GetId())
+		}
+		r, ok, err := c.data.Get(key)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		if _, duplicate := removed[key]; duplicate || !ok || r.Version != removal.GetVersion() {
+			response.Skipped++
+			continue
+		}
+		removed[key] = struct{}{}
+		mutations = append(mutations, Mutation{ID: key})
+		response.Removed++
+	}
+	if len(removed) > 0 {
+		keys, err := c.data.Keys()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		for _, key := range keys {
+			if owner, ok := historyOwner(key); ok {
+				if _, ok := removed[owner]; ok {
+					mutations = append(mutations, Mutation{ID: key})
+				}
+			}
+		}
+	}
+	if err := c.applyMutations(mutations); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
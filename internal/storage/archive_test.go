@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// exportStream collects chunks of exported archive
+type exportStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	archive bytes.Buffer
+}
+
+func (s *exportStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *exportStream) Send(response *pbAdmin.ExportResponse) error {
+	s.archive.Write(response.GetChunk())
+	return nil
+}
+
+// importStream sends header and archive by small chunks
+type importStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []*pbAdmin.ImportRequest
+	response *pbAdmin.ImportResponse
+}
+
+func newImportStream(ctx context.Context, options *pbAdmin.ImportOptions, archive []byte) *importStream {
+	s := &importStream{ctx: ctx}
+	s.requests = append(s.requests, &pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Header{Header: options}})
+	for len(archive) > 0 {
+		n := 100
+		if n > len(archive) {
+			n = len(archive)
+		}
+		s.requests = append(s.requests, &pbAdmin.ImportRequest{Part: &pbAdmin.ImportRequest_Chunk{Chunk: archive[:n]}})
+		archive = archive[n:]
+	}
+	return s
+}
+
+func (s *importStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *importStream) Recv() (*pbAdmin.ImportRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	request := s.requests[0]
+	s.requests = s.requests[1:]
+	return request, nil
+}
+
+func (s *importStream) SendAndClose(response *pbAdmin.ImportResponse) error {
+	s.response = response
+	return nil
+}
+
+func newArchiveStorage(t *testing.T) *storageServer {
+	s, err := New(NewMemoryBackend(), Options{TombstoneRetention: time.Hour, HistoryDepth: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func exportArchive(t *testing.T, s *storageServer) []byte {
+	stream := &exportStream{ctx: context.Background()}
+	if err := s.Export(&pbAdmin.ExportRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	return stream.archive.Bytes()
+}
+
+// archiveEntries returns entries of verified archive
+func archiveEntries(t *testing.T, archive []byte) []archiveEntry {
+	var entries []archiveEntry
+	if _, _, err := readArchive(bytes.NewReader(archive), func(entry archiveEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newArchiveStorage(t)
+	if _, err := src.CreateCollection(ctx, &pbCRUD.CreateCollectionRequest{Collection: &pbCRUD.Collection{Name: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	inCollection := metadata.NewIncomingContext(ctx, metadata.Pairs(collectionMetadataKey, "c"))
+	steps := []func() error{
+		func() error {
+			_, err := src.Create(ctx, &pbCRUD.CreateRequest{Id: "a", Raw: []byte(`{"v":1}`)})
+			return err
+		},
+		func() error {
+			_, err := src.Update(ctx, &pbCRUD.UpdateRequest{Data: &pbCRUD.Data{Id: "a", Raw: []byte(`{"v":2}`)}})
+			return err
+		},
+		func() error {
+			_, err := src.Create(ctx, &pbCRUD.CreateRequest{Id: "b", Raw: []byte("plain text")})
+			return err
+		},
+		func() error {
+			_, err := src.Delete(ctx, &pbCRUD.DeleteRequest{Id: "b"})
+			return err
+		},
+		func() error {
+			_, err := src.Create(inCollection, &pbCRUD.CreateRequest{Id: "a", Raw: []byte(`{"c":true}`)})
+			return err
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := exportArchive(t, src)
+	entries := archiveEntries(t, archive)
+
+	dst := newArchiveStorage(t)
+	stream := newImportStream(ctx, &pbAdmin.ImportOptions{}, archive)
+	if err := dst.Import(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.response.GetRecords() != uint64(len(entries)) || stream.response.GetCreated() == 0 {
+		t.Fatalf("import response %v for %d records of archive", stream.response, len(entries))
+	}
+
+	// archive of imported storage has the same entries, so records, history, tombstones and collections are restored
+	if restored := archiveEntries(t, exportArchive(t, dst)); !reflect.DeepEqual(restored, entries) {
+		want, _ := json.Marshal(entries)
+		actual, _ := json.Marshal(restored)
+		t.Fatalf("restored entries %s, want %s", actual, want)
+	}
+	if r, err := dst.ReadVersion(ctx, &pbCRUD.ReadVersionRequest{Id: "a", Version: 1}); err != nil || string(r.GetRaw()) != `{"v":1}` {
+		t.Errorf("read version 1 of 'a': %v, %v", r, err)
+	}
+	if _, err := dst.Undelete(ctx, &pbCRUD.UndeleteRequest{Id: "b"}); err != nil {
+		t.Errorf("undelete of 'b': %v", err)
+	}
+	if r, err := dst.Read(inCollection, &pbCRUD.ReadRequest{Id: "a"}); err != nil || string(r.GetRaw()) != `{"c":true}` {
+		t.Errorf("read 'a' of collection: %v, %v", r, err)
+	}
+
+	// second import of the same archive changes nothing
+	stream = newImportStream(ctx, &pbAdmin.ImportOptions{}, archive)
+	if err := dst.Import(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.response.GetCreated() != 0 || stream.response.GetUpdated() != 0 {
+		t.Errorf("second import response %v", stream.response)
+	}
+}
+
+func TestImportChecksum(t *testing.T) {
+	ctx := context.Background()
+	src := newArchiveStorage(t)
+	for _, id := range []string{"a", "b"} {
+		if _, err := src.Create(ctx, &pbCRUD.CreateRequest{Id: id, Raw: []byte(`"` + id + `"`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := exportArchive(t, src)
+	lines := bytes.SplitAfter(archive, []byte("\n"))
+	// header, records a and b, trailer and empty tail
+	if len(lines) != 5 {
+		t.Fatalf("archive of %d lines: %s", len(lines), archive)
+	}
+	join := func(lines ...[]byte) []byte {
+		return bytes.Join(lines, nil)
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		// value of b is replaced by "c"
+		{name: "changed record", archive: bytes.Replace(archive, []byte(`"ImIi"`), []byte(`"ImMi"`), 1)},
+		{name: "changed header", archive: bytes.Replace(archive, []byte(`"sequence":`), []byte(`"sequence":1`), 1)},
+		{name: "missing record", archive: join(lines[0], lines[2], lines[3])},
+		{name: "reordered records", archive: join(lines[0], lines[2], lines[1], lines[3])},
+		{name: "duplicated record", archive: join(lines[0], lines[1], lines[1], lines[3])},
+		{name: "missing trailer", archive: join(lines[0], lines[1], lines[2])},
+		{name: "torn trailer", archive: archive[:len(archive)-10]},
+		{name: "data after trailer", archive: join(archive, lines[1])},
+		{name: "empty archive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bytes.Equal(test.archive, archive) {
+				t.Fatal("archive is not changed")
+			}
+			dst := newArchiveStorage(t)
+			err := dst.Import(newImportStream(ctx, &pbAdmin.ImportOptions{}, test.archive))
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("import: %v, want InvalidArgument", err)
+			}
+			// archive is verified before any record is applied
+			list, err := dst.List(ctx, &pbCRUD.ListRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.GetItems()) != 0 {
+				t.Fatalf("imported %v", list.GetItems())
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import "time"
+
+// Record is a value stored by storageServer
+type Record struct {
+	Raw []byte `json:"raw"`
+	// Version starts from 1 on create and increments on every update
+	Version uint64 `json:"version"`
+	// ExpiresAt is zero if record does not expire
+	ExpiresAt time.Time `json:"expires_at"`
+
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	// Size is a size of Raw
+	Size uint64 `json:"size"`
+	// DeletedAt is not zero if record is a tombstone of deleted record
+	DeletedAt time.Time `json:"deleted_at"`
+	// Encoding of Raw in backend, empty for original bytes. Records outside of backend are never encoded
+	Encoding string `json:"encoding,omitempty"`
+	// KeyID is an id of master key which encrypts DataKey, empty for plaintext Raw.
+	// Records outside of backend are never encrypted
+	KeyID string `json:"key_id,omitempty"`
+	// DataKey is an encrypted key of Raw
+	DataKey []byte `json:"data_key,omitempty"`
+	// Blob is a SHA-256 of value in hex if value is kept in blob shared by records with same value, Raw is empty then.
+	// Records outside of backend never reference blobs
+	Blob string `json:"blob,omitempty"`
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+func (r *Record) deleted() bool {
+	return !r.DeletedAt.IsZero()
+}
+
+// Mutation creates or replaces record by id. Nil Record removes record,
+// removing of not existing record is not an error
+type Mutation struct {
+	ID     string  `json:"id"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// Backend keeps records of storageServer.
+// Implementations must be goroutine-safe: storageServer applies mutations of different keys concurrently,
+// but never applies mutations of same key concurrently
+type Backend interface {
+	// Get returns record by id. ok is false if record not exists
+	Get(id string) (r *Record, ok bool, err error)
+
+	// Apply atomically writes all mutations: either all of them are applied or none
+	Apply(mutations ...Mutation) error
+
+	// Keys returns ids of all records in any order
+	Keys() ([]string, error)
+
+	// Close releases backend resources
+	Close() error
+}
@@ -0,0 +1,438 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// collectionMetadataKey is a key of gRPC metadata with name of collection of request
+const collectionMetadataKey = "collection"
+
+// collectionIDPrefix is a prefix of system records which keep collection settings
+const collectionIDPrefix = systemIDPrefix + "collection:"
+
+// collectionKeyPrefix is a prefix of keys of records of named collections. Key of record is a prefix,
+// name of collection, zero byte and id of record. Records of default collection are keyed by their ids
+const collectionKeyPrefix = "\x01"
+
+const maxCollectionNameLength = 64
+
+// collection keeps settings of named collection
+type collection struct {
+	Name       string          `json:"name"`
+	DefaultTTL time.Duration   `json:"default_ttl"`
+	Quota      Quota           `json:"quota"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+
+	Compression        pbCRUD.Collection_CompressionMode `json:"compression,omitempty"`
+	CompressionMinSize uint64                            `json:"compression_min_size,omitempty"`
+
+	// validator is a compiled Schema, nil if collection has no schema
+	validator *schema
+}
+
+// compile compiles schema of collection
+func (c *collection) compile() error {
+	if c.Schema == nil {
+		return nil
+	}
+	validator, err := compileSchema(c.Schema)
+	if err != nil {
+		return err
+	}
+	c.validator = validator
+	return nil
+}
+
+func collectionFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if collections := md.Get(collectionMetadataKey); len(collections) > 0 {
+		return collections[0]
+	}
+	return ""
+}
+
+// recordKey returns key of record in backend
+func recordKey(collection, id string) string {
+	if collection == "" {
+		return id
+	}
+	return collectionKeyPrefix + collection + "\x00" + id
+}
+
+// splitKey returns collection and id of record by key in backend
+func splitKey(key string) (collection, id string) {
+	if !strings.HasPrefix(key, collectionKeyPrefix) {
+		return "", key
+	}
+	collection, id, _ = strings.Cut(key[len(collectionKeyPrefix):], "\x00")
+	return collection, id
+}
+
+func validateCollectionName(name string) error {
+	switch {
+	case name == "":
+		return status.Errorf(codes.InvalidArgument, "empty collection name")
+	case len(name) > maxCollectionNameLength:
+		return status.Errorf(codes.InvalidArgument, "collection name is longer than %d bytes", maxCollectionNameLength)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return status.Errorf(codes.InvalidArgument, "collection name '%s' contains '%c'", name, r)
+		}
+	}
+	return nil
+}
+
+// collection returns settings of collection, nil settings means default collection without schema.
+// Caller holds dataMtx
+func (c *storageServer) collection(name string) (*collection, error) {
+	if name == "" {
+		return c.collections[""], nil
+	}
+	settings, ok := c.collections[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "collection '%s' not exists", name)
+	}
+	return settings, nil
+}
+
+func (c *storageServer) CreateCollection(ctx context.Context, request *pbCRUD.CreateCollectionRequest) (_ *pbCRUD.CreateCollectionResponse, err error) {
+	log.Info().Caller().Str("collection", request.GetCollection().GetName()).Msg("create collection")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("create collection failed")
+		} else {
+			log.Info().Caller().Msg("create collection done")
+		}
+	}()
+
+	settings, err := collectionOfProto(request.GetCollection())
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.createCollection(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.CreateCollectionResponse{}, nil
+}
+
+func collectionOfProto(p *pbCRUD.Collection) (*collection, error) {
+	if err := validateCollectionName(p.GetName()); err != nil {
+		return nil, err
+	}
+	settings := &collection{
+		Name: p.GetName(),
+		Quota: Quota{
+			MaxRecords:    p.GetMaxRecords(),
+			MaxBytes:      p.GetMaxBytes(),
+			MaxObjectSize: p.GetMaxObjectSize(),
+		},
+		Compression:        p.GetCompression(),
+		CompressionMinSize: p.GetCompressionMinSize(),
+	}
+	if ttl := p.GetDefaultTtl(); ttl != nil {
+		if err := ttl.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong default ttl: %s", err.Error())
+		}
+		if ttl.AsDuration() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "negative default ttl")
+		}
+		settings.DefaultTTL = ttl.AsDuration()
+	}
+	if p.GetSchema() != nil {
+		schema, err := protojson.Marshal(p.GetSchema())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong schema: %s", err.Error())
+		}
+		settings.Schema = schema
+		if err := settings.compile(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong schema: %s", err.Error())
+		}
+	}
+	return settings, nil
+}
+
+func (c *storageServer) createCollection(ctx context.Context, settings *collection) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+
+	return c.alter(ctx, func(t *tx) error {
+		if _, ok := c.collections[settings.Name]; ok {
+			return status.Errorf(codes.AlreadyExists, "collection '%s' already exists", settings.Name)
+		}
+		t.put(collectionIDPrefix+settings.Name, &Record{
+			Raw:       raw,
+			Version:   1,
+			CreatedAt: t.now,
+			UpdatedAt: t.now,
+			CreatedBy: t.user,
+			Size:      uint64(len(raw)),
+		})
+		t.commit = append(t.commit, func() {
+			c.collections[settings.Name] = settings
+		})
+		return nil
+	})
+}
+
+func (c *storageServer) DropCollection(ctx context.Context, request *pbCRUD.DropCollectionRequest) (_ *pbCRUD.DropCollectionResponse, err error) {
+	log.Info().Caller().Str("collection", request.GetName()).Msg("drop collection")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("drop collection failed")
+		} else {
+			log.Info().Caller().Msg("drop collection done")
+		}
+	}()
+
+	err = c.dropCollection(ctx, request.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.DropCollectionResponse{}, nil
+}
+
+// dropCollection removes collection with all its records at once
+func (c *storageServer) dropCollection(ctx context.Context, name string) error {
+	return c.alter(ctx, func(t *tx) error {
+		// settings of default collection keep its schema only, default collection is not dropped
+		if _, ok := c.collections[name]; !ok || name == "" {
+			return status.Errorf(codes.NotFound, "collection '%s' not exists", name)
+		}
+		keys, err := c.data.Keys()
+		if err != nil {
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		prefix := recordKey(name, "")
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			t.putKey(key, nil)
+			t.notifyIn(name, pbCDC.ListenResponse_Deleted, &pbCDC.Data{
+				Id: key[len(prefix):],
+			})
+		}
+		t.put(collectionIDPrefix+name, nil)
+		t.commit = append(t.commit, func() {
+			delete(c.collections, name)
+			c.collectionsUsage.remove(name)
+		})
+		return nil
+	})
+}
+
+func (c *storageServer) ListCollections(ctx context.Context, request *pbCRUD.ListCollectionsRequest) (_ *pbCRUD.ListCollectionsResponse, err error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	collections := make([]*pbCRUD.Collection, 0, len(c.collections))
+	for _, settings := range c.collections {
+		if settings.Name == "" {
+			continue
+		}
+		u := c.collectionsUsage.get(settings.Name)
+		p := &pbCRUD.Collection{
+			Name:          settings.Name,
+			MaxRecords:    settings.Quota.MaxRecords,
+			MaxBytes:      settings.Quota.MaxBytes,
+			MaxObjectSize: settings.Quota.MaxObjectSize,
+			Records:       uint64(u.records),
+			Bytes:         uint64(u.bytes),
+
+			Compression:        settings.Compression,
+			CompressionMinSize: settings.CompressionMinSize,
+		}
+		if settings.DefaultTTL > 0 {
+			p.DefaultTtl = durationpb.New(settings.DefaultTTL)
+		}
+		if settings.Schema != nil {
+			p.Schema = &structpb.Struct{}
+			if err := protojson.Unmarshal(settings.Schema, p.Schema); err != nil {
+				return nil, status.Errorf(codes.Internal, err.Error())
+			}
+		}
+		collections = append(collections, p)
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+
+	return &pbCRUD.ListCollectionsResponse{Collections: collections}, nil
+}
+
+func (c *storageServer) SetSchema(ctx context.Context, request *pbCRUD.SetSchemaRequest) (_ *pbCRUD.SetSchemaResponse, err error) {
+	log.Info().Caller().Str("collection", request.GetCollection()).Msg("set schema")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("set schema failed")
+		} else {
+			log.Info().Caller().Msg("set schema done")
+		}
+	}()
+
+	var (
+		raw       json.RawMessage
+		validator *schema
+	)
+	if request.GetSchema() != nil {
+		raw, err = protojson.Marshal(request.GetSchema())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong schema: %s", err.Error())
+		}
+		validator, err = compileSchema(raw)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong schema: %s", err.Error())
+		}
+	}
+
+	err = c.setSchema(ctx, request.GetCollection(), raw, validator)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.SetSchemaResponse{}, nil
+}
+
+// setSchema replaces schema of collection after all stored records of collection are validated by it.
+// Default collection has settings only while it has schema
+func (c *storageServer) setSchema(ctx context.Context, name string, raw json.RawMessage, validator *schema) error {
+	return c.alter(ctx, func(t *tx) error {
+		old, ok := c.collections[name]
+		if !ok && name != "" {
+			return status.Errorf(codes.NotFound, "collection '%s' not exists", name)
+		}
+		settings := &collection{Name: name}
+		if ok {
+			copied := *old
+			settings = &copied
+		}
+		settings.Schema, settings.validator = raw, validator
+
+		if validator != nil {
+			if err := c.validateCollection(name, validator); err != nil {
+				return err
+			}
+		}
+
+		id := collectionIDPrefix + name
+		if name == "" && raw == nil {
+			t.put(id, nil)
+			t.commit = append(t.commit, func() {
+				delete(c.collections, name)
+			})
+			return nil
+		}
+		value, err := json.Marshal(settings)
+		if err != nil {
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		r := &Record{
+			Raw:       value,
+			Version:   1,
+			CreatedAt: t.now,
+			UpdatedAt: t.now,
+			CreatedBy: t.user,
+			Size:      uint64(len(value)),
+		}
+		if stored, ok, err := t.get(id); err != nil {
+			return err
+		} else if ok {
+			r.Version, r.CreatedAt, r.CreatedBy = stored.Version+1, stored.CreatedAt, stored.CreatedBy
+		}
+		t.put(id, r)
+		t.commit = append(t.commit, func() {
+			c.collections[name] = settings
+		})
+		return nil
+	})
+}
+
+// validateCollection fails if some stored record of collection violates schema. Tombstones are not validated.
+// Caller holds dataMtx for writing
+func (c *storageServer) validateCollection(name string, validator *schema) error {
+	keys, err := c.data.Keys()
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isSystemID(key) {
+			continue
+		}
+		if collection, _ := splitKey(key); collection != name {
+			continue
+		}
+		r, ok, err := c.data.Get(key)
+		if err != nil {
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		if !ok || r.deleted() || r.expired(time.Now()) {
+			continue
+		}
+		if violations := validator.validate(r.Raw); len(violations) > 0 {
+			_, id := splitKey(key)
+			return violationsError(codes.FailedPrecondition,
+				fmt.Sprintf("record '%s' violates schema of collection '%s'", id, name), violations)
+		}
+	}
+	return nil
+}
+
+// loadCollections reads stored collection settings
+func (c *storageServer) loadCollections() error {
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	ids, err := c.data.Keys()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, collectionIDPrefix) {
+			continue
+		}
+		r, ok, err := c.data.Get(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var settings collection
+		if err := json.Unmarshal(r.Raw, &settings); err != nil {
+			return err
+		}
+		// schemas stored before validation was supported may use unsupported keywords
+		if err := settings.compile(); err != nil {
+			log.Error().Caller().Err(err).Str("collection", settings.Name).Msg("schema is not enforced")
+		}
+		c.collections[settings.Name] = &settings
+		log.Info().Caller().Str("collection", settings.Name).Msg("collection loaded")
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// encodingGzip is an encoding of values compressed by gzip
+const encodingGzip = "gzip"
+
+// Compression configures transparent compression of stored values
+type Compression struct {
+	// Enabled compresses values of default collection and of collections without own setting
+	Enabled bool
+	// MinSize is a min size of compressed value, smaller values are stored as is
+	MinSize uint64
+}
+
+// compression returns compression settings of record by backend key. Caller holds dataMtx
+func (c *storageServer) compression(key string) Compression {
+	settings := c.opts.Compression
+	name, _ := splitKey(key)
+	if name == "" {
+		return settings
+	}
+	if collection, ok := c.collections[name]; ok {
+		switch collection.Compression {
+		case pbCRUD.Collection_Enabled:
+			settings.Enabled = true
+		case pbCRUD.Collection_Disabled:
+			settings.Enabled = false
+		}
+		if collection.CompressionMinSize > 0 {
+			settings.MinSize = collection.CompressionMinSize
+		}
+	}
+	return settings
+}
+
+type compressionStats struct {
+	records     int64
+	compressed  int64
+	rawBytes    int64
+	storedBytes int64
+}
+
+func (s *compressionStats) merge(delta compressionStats) {
+	s.records += delta.records
+	s.compressed += delta.compressed
+	s.rawBytes += delta.rawBytes
+	s.storedBytes += delta.storedBytes
+}
+
+func (s *compressionStats) add(r *Record, sign int64) {
+	s.records += sign
+	if r.Encoding != "" {
+		s.compressed += sign
+	}
+	// value of record which references blob is accounted in blob
+	if r.Blob == "" {
+		s.rawBytes += sign * int64(r.Size)
+	}
+	s.storedBytes += sign * int64(len(r.Raw))
+}
+
+// compressingBackend compresses values of records on Apply and decompresses them on Get.
+// Value is stored compressed only if it becomes smaller
+type compressingBackend struct {
+	Backend
+
+	settings func(key string) Compression
+
+	// read-write access
+	statsMtx sync.Mutex
+	stats    compressionStats
+
+	// writers are reused by concurrent writes
+	writers sync.Pool
+}
+
+func newCompressingBackend(b Backend, settings func(key string) Compression) *compressingBackend {
+	c := &compressingBackend{
+		Backend:  b,
+		settings: settings,
+	}
+	c.writers.New = func() interface{} {
+		return gzip.NewWriter(nil)
+	}
+	return c
+}
+
+func (c *compressingBackend) currentStats() compressionStats {
+	c.statsMtx.Lock()
+	defer c.statsMtx.Unlock()
+
+	return c.stats
+}
+
+// loadStats accounts stored records in compression stats
+func (c *compressingBackend) loadStats() error {
+	keys, err := c.Backend.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r, ok, err := c.Backend.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.stats.add(r, 1)
+		}
+	}
+	return nil
+}
+
+func (c *compressingBackend) Get(id string) (*Record, bool, error) {
+	r, ok, err := c.Backend.Get(id)
+	if err != nil || !ok || r.Encoding == "" {
+		return r, ok, err
+	}
+	if r.Encoding != encodingGzip {
+		return nil, false, fmt.Errorf("unknown encoding '%s' of record '%s'", r.Encoding, id)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(r.Raw))
+	if err != nil {
+		return nil, false, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, false, err
+	}
+	decoded := *r
+	decoded.Raw = raw
+	decoded.Encoding = ""
+	return &decoded, true, nil
+}
+
+func (c *compressingBackend) Apply(mutations ...Mutation) error {
+	var delta compressionStats
+	encoded := make([]Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		old, ok, err := c.Backend.Get(m.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			delta.add(old, -1)
+		}
+		if m.Record != nil {
+			r, err := c.compress(m.ID, m.Record)
+			if err != nil {
+				return err
+			}
+			m.Record = r
+			delta.add(r, 1)
+		}
+		encoded = append(encoded, m)
+	}
+	if err := c.Backend.Apply(encoded...); err != nil {
+		return err
+	}
+	c.statsMtx.Lock()
+	c.stats.merge(delta)
+	c.statsMtx.Unlock()
+	return nil
+}
+
+// compress returns compressed copy of record or record itself if compression is disabled or useless
+func (c *compressingBackend) compress(key string, r *Record) (*Record, error) {
+	settings := c.settings(key)
+	if !settings.Enabled || uint64(len(r.Raw)) < settings.MinSize || len(r.Raw) == 0 {
+		return r, nil
+	}
+	var buf bytes.Buffer
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(r.Raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(r.Raw) {
+		return r, nil
+	}
+	compressed := *r
+	compressed.Raw = buf.Bytes()
+	compressed.Encoding = encodingGzip
+	return &compressed, nil
+}
+
+func (c *storageServer) CompressionStats(ctx context.Context, request *pbAdmin.CompressionStatsRequest) (_ *pbAdmin.CompressionStatsResponse, err error) {
+	log.Info().Caller().Msg("compression stats")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("compression stats failed")
+		} else {
+			log.Info().Caller().Msg("compression stats done")
+		}
+	}()
+
+	stats := c.compressor.currentStats()
+
+	response := &pbAdmin.CompressionStatsResponse{
+		Records:           uint64(stats.records),
+		CompressedRecords: uint64(stats.compressed),
+		RawBytes:          uint64(stats.rawBytes),
+		StoredBytes:       uint64(stats.storedBytes),
+		Ratio:             1,
+	}
+	if stats.rawBytes > stats.storedBytes {
+		response.SavedBytes = uint64(stats.rawBytes - stats.storedBytes)
+	}
+	if stats.storedBytes > 0 {
+		response.Ratio = float64(stats.rawBytes) / float64(stats.storedBytes)
+	}
+	return response, nil
+}
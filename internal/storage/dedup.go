@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+// blobIDPrefix is a prefix of system records which keep values shared by records, key of blob is
+// the prefix and SHA-256 of value in hex
+const blobIDPrefix = systemIDPrefix + "blob:"
+
+// Dedup configures content-addressed deduplication of stored values.
+// Blobs are keyed by SHA-256 of values, so hashes of values are visible in backend even if encryption is enabled
+type Dedup struct {
+	// Enabled stores every distinct value of records once in blob shared by records with that value
+	Enabled bool
+	// MinSize is a min size of deduplicated value, smaller values are kept in records
+	MinSize uint64
+}
+
+type dedupStats struct {
+	// records which reference blobs and total size of their values
+	records      int64
+	logicalBytes int64
+	// blobs and total size of their values
+	blobs     int64
+	blobBytes int64
+}
+
+// blob is a stored blob: count of records which reference it and size of its value
+type blob struct {
+	refs int64
+	size int64
+}
+
+// dedupingBackend moves values of records to blobs keyed by hashes of values on Apply and reads them back on Get.
+// Blob is written with its first reference and is removed with its last one. Counts of references are not stored,
+// they are counted on load. Blobs are hidden from Get and Keys, so callers see records with values only
+type dedupingBackend struct {
+	Backend
+
+	settings Dedup
+
+	// writes of blob are serialized by stripe of its key, so write of first reference and removal of last one
+	// are applied in same order as references are counted
+	locks stripes
+	// writes of record are serialized with reads of its blob by stripe of record key, so blob is not removed
+	// by overwrite of record while it is read. Stripes of records are locked before stripes of blobs
+	recordLocks stripes
+
+	// read-write access
+	blobsMtx sync.Mutex
+	blobs    map[string]*blob
+	stats    dedupStats
+}
+
+func newDedupingBackend(b Backend, settings Dedup) *dedupingBackend {
+	return &dedupingBackend{
+		Backend:     b,
+		settings:    settings,
+		locks:       newStripes(defaultLockStripes),
+		recordLocks: newStripes(defaultLockStripes),
+		blobs:       make(map[string]*blob),
+	}
+}
+
+func isBlobID(id string) bool {
+	return strings.HasPrefix(id, blobIDPrefix)
+}
+
+// load counts references of stored blobs and removes blobs without references
+func (d *dedupingBackend) load() error {
+	keys, err := d.Backend.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r, ok, err := d.Backend.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case isBlobID(key):
+			b := d.blob(strings.TrimPrefix(key, blobIDPrefix))
+			b.size = int64(r.Size)
+			d.stats.blobs++
+			d.stats.blobBytes += b.size
+		case r.Blob != "":
+			d.blob(r.Blob).refs++
+			d.stats.records++
+			d.stats.logicalBytes += int64(r.Size)
+		}
+	}
+
+	var orphans []Mutation
+	for hash, b := range d.blobs {
+		if b.refs == 0 {
+			orphans = append(orphans, Mutation{ID: blobIDPrefix + hash})
+			delete(d.blobs, hash)
+			d.stats.blobs--
+			d.stats.blobBytes -= b.size
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	log.Info().Caller().Int("blobs", len(orphans)).Msg("blobs without references removed")
+	return d.Backend.Apply(orphans...)
+}
+
+// blob returns blob by hash, it is added if not exists
+func (d *dedupingBackend) blob(hash string) *blob {
+	b, ok := d.blobs[hash]
+	if !ok {
+		b = &blob{}
+		d.blobs[hash] = b
+	}
+	return b
+}
+
+func (d *dedupingBackend) currentStats() dedupStats {
+	d.blobsMtx.Lock()
+	defer d.blobsMtx.Unlock()
+
+	return d.stats
+}
+
+func (d *dedupingBackend) Get(id string) (*Record, bool, error) {
+	if isBlobID(id) {
+		return nil, false, nil
+	}
+	r, ok, err := d.Backend.Get(id)
+	if err != nil || !ok || r.Blob == "" {
+		return r, ok, err
+	}
+
+	// record is read again under its stripe: it may be overwritten and its blob may be removed meanwhile
+	locks := d.recordLocks.lockAll([]int{d.recordLocks.of(id)})
+	defer locks.unlock()
+	r, ok, err = d.Backend.Get(id)
+	if err != nil || !ok || r.Blob == "" {
+		return r, ok, err
+	}
+	b, ok, err := d.Backend.Get(blobIDPrefix + r.Blob)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, fmt.Errorf("blob '%s' of record '%s' not found", r.Blob, id)
+	}
+	resolved := *r
+	resolved.Raw = b.Raw
+	resolved.Blob = ""
+	return &resolved, true, nil
+}
+
+func (d *dedupingBackend) Keys() ([]string, error) {
+	keys, err := d.Backend.Keys()
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !isBlobID(key) {
+			visible = append(visible, key)
+		}
+	}
+	return visible, nil
+}
+
+// dedupable is true if value of record is moved to blob
+func (d *dedupingBackend) dedupable(id string, r *Record) bool {
+	return d.settings.Enabled && !isSystemID(id) && len(r.Raw) > 0 && uint64(len(r.Raw)) >= d.settings.MinSize
+}
+
+// blobDelta is a change of references of blob by mutations
+type blobDelta struct {
+	refs         int64
+	logicalBytes int64
+	// value of blob if mutations reference it
+	raw []byte
+}
+
+func (d *dedupingBackend) Apply(mutations ...Mutation) error {
+	records := make([]int, 0, len(mutations))
+	for _, m := range mutations {
+		records = append(records, d.recordLocks.of(m.ID))
+	}
+	recordLocks := d.recordLocks.lockAll(records)
+	defer recordLocks.unlock()
+
+	deltas := make(map[string]*blobDelta)
+	delta := func(hash string) *blobDelta {
+		bd, ok := deltas[hash]
+		if !ok {
+			bd = &blobDelta{}
+			deltas[hash] = bd
+		}
+		return bd
+	}
+
+	encoded := make([]Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		if isBlobID(m.ID) {
+			return fmt.Errorf("key '%s' is reserved for blobs", m.ID)
+		}
+		old, ok, err := d.Backend.Get(m.ID)
+		if err != nil {
+			return err
+		}
+		if ok && old.Blob != "" {
+			bd := delta(old.Blob)
+			bd.refs--
+			bd.logicalBytes -= int64(old.Size)
+		}
+		if m.Record != nil && d.dedupable(m.ID, m.Record) {
+			sum := sha256.Sum256(m.Record.Raw)
+			hash := hex.EncodeToString(sum[:])
+			bd := delta(hash)
+			bd.refs++
+			bd.logicalBytes += int64(m.Record.Size)
+			bd.raw = m.Record.Raw
+			ref := *m.Record
+			ref.Raw = nil
+			ref.Blob = hash
+			m.Record = &ref
+		}
+		encoded = append(encoded, m)
+	}
+	if len(deltas) == 0 {
+		return d.Backend.Apply(encoded...)
+	}
+
+	ids := make([]int, 0, len(deltas))
+	for hash := range deltas {
+		ids = append(ids, d.locks.of(blobIDPrefix+hash))
+	}
+	locks := d.locks.lockAll(ids)
+	defer locks.unlock()
+
+	// blobs are written with their first reference and are removed with their last one
+	now := time.Now()
+	d.blobsMtx.Lock()
+	for hash, bd := range deltas {
+		var refs int64
+		if b, ok := d.blobs[hash]; ok {
+			refs = b.refs
+		}
+		switch {
+		case refs == 0 && bd.refs > 0:
+			encoded = append(encoded, Mutation{ID: blobIDPrefix + hash, Record: &Record{
+				Raw:       bd.raw,
+				Version:   1,
+				CreatedAt: now,
+				UpdatedAt: now,
+				Size:      uint64(len(bd.raw)),
+			}})
+		case refs > 0 && refs+bd.refs <= 0:
+			encoded = append(encoded, Mutation{ID: blobIDPrefix + hash})
+		}
+	}
+	d.blobsMtx.Unlock()
+
+	if err := d.Backend.Apply(encoded...); err != nil {
+		return err
+	}
+
+	d.blobsMtx.Lock()
+	defer d.blobsMtx.Unlock()
+	for hash, bd := range deltas {
+		b, ok := d.blobs[hash]
+		if !ok {
+			if bd.refs <= 0 {
+				continue
+			}
+			b = &blob{size: int64(len(bd.raw))}
+			d.blobs[hash] = b
+			d.stats.blobs++
+			d.stats.blobBytes += b.size
+		}
+		b.refs += bd.refs
+		d.stats.records += bd.refs
+		d.stats.logicalBytes += bd.logicalBytes
+		if b.refs <= 0 {
+			delete(d.blobs, hash)
+			d.stats.blobs--
+			d.stats.blobBytes -= b.size
+		}
+	}
+	return nil
+}
+
+func (c *storageServer) DedupStats(ctx context.Context, request *pbAdmin.DedupStatsRequest) (_ *pbAdmin.DedupStatsResponse, err error) {
+	log.Info().Caller().Msg("dedup stats")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("dedup stats failed")
+		} else {
+			log.Info().Caller().Msg("dedup stats done")
+		}
+	}()
+
+	stats := c.deduper.currentStats()
+
+	response := &pbAdmin.DedupStatsResponse{
+		Enabled:      c.opts.Dedup.Enabled,
+		Records:      uint64(stats.records),
+		Blobs:        uint64(stats.blobs),
+		LogicalBytes: uint64(stats.logicalBytes),
+		BlobBytes:    uint64(stats.blobBytes),
+		Ratio:        1,
+	}
+	if stats.logicalBytes > stats.blobBytes {
+		response.SavedBytes = uint64(stats.logicalBytes - stats.blobBytes)
+	}
+	if stats.blobBytes > 0 {
+		response.Ratio = float64(stats.logicalBytes) / float64(stats.blobBytes)
+	}
+	return response, nil
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+func TestDedupReadWhileOverwrite(t *testing.T) {
+	d := newDedupingBackend(NewMemoryBackend(), Dedup{Enabled: true})
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"value":%d}`, i))
+	}
+	if err := d.Apply(Mutation{ID: "a", Record: &Record{Raw: value(0), Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every overwrite removes blob of previous value, so reader which sees old record reads removed blob
+	// unless overwrite waits for it
+	const writes = 20000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			if err := d.Apply(Mutation{ID: "a", Record: &Record{Raw: value(i), Version: uint64(i + 1)}}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r, ok, err := d.Get("a")
+				if err != nil || !ok {
+					t.Error(ok, err)
+					return
+				}
+				if string(r.Raw) != string(value(int(r.Version)-1)) {
+					t.Errorf("version %d has value %s", r.Version, r.Raw)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := d.currentStats()
+	if stats.blobs != 1 || stats.records != 1 {
+		t.Fatalf("blobs %d, records %d", stats.blobs, stats.records)
+	}
+}
+
+func TestDedupReferences(t *testing.T) {
+	s, err := New(NewMemoryBackend(), Options{Dedup: Dedup{Enabled: true}, TombstoneRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	x, y := []byte(`{"value":"x"}`), []byte(`{"value":"y"}`)
+
+	create := func(id string, raw []byte) func() error {
+		return func() error {
+			_, err := s.Create(ctx, &pbCRUD.CreateRequest{Id: id, Raw: raw})
+			return err
+		}
+	}
+	update := func(id string, raw []byte) func() error {
+		return func() error {
+			_, err := s.Update(ctx, &pbCRUD.UpdateRequest{Data: &pbCRUD.Data{Id: id, Raw: raw}})
+			return err
+		}
+	}
+	remove := func(id string) func() error {
+		return func() error {
+			_, err := s.Delete(ctx, &pbCRUD.DeleteRequest{Id: id})
+			return err
+		}
+	}
+	undelete := func(id string) func() error {
+		return func() error {
+			_, err := s.Undelete(ctx, &pbCRUD.UndeleteRequest{Id: id})
+			return err
+		}
+	}
+	purge := func(id string) func() error {
+		return func() error {
+			_, err := s.Purge(ctx, &pbCRUD.PurgeRequest{Id: id})
+			return err
+		}
+	}
+
+	// steps run in order over same storage, tombstones reference values of deleted records
+	steps := []struct {
+		name  string
+		do    func() error
+		xRefs int64
+		yRefs int64
+		blobs int64
+	}{
+		{name: "create a", do: create("a", x), xRefs: 1, blobs: 1},
+		{name: "create b with same value", do: create("b", x), xRefs: 2, blobs: 1},
+		{name: "update a", do: update("a", y), xRefs: 1, yRefs: 1, blobs: 2},
+		{name: "update b", do: update("b", y), yRefs: 2, blobs: 1},
+		{name: "update b with same value", do: update("b", y), yRefs: 2, blobs: 1},
+		{name: "delete a", do: remove("a"), yRefs: 2, blobs: 1},
+		{name: "purge a", do: purge("a"), yRefs: 1, blobs: 1},
+		{name: "delete b", do: remove("b"), yRefs: 1, blobs: 1},
+		{name: "undelete b", do: undelete("b"), yRefs: 1, blobs: 1},
+		{name: "update b back", do: update("b", x), xRefs: 1, blobs: 1},
+		{name: "delete b again", do: remove("b"), xRefs: 1, blobs: 1},
+		{name: "purge b", do: purge("b")},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		stats := s.deduper.currentStats()
+		if refs := blobRefs(s.deduper, x); refs != step.xRefs {
+			t.Errorf("%s: x has %d references, want %d", step.name, refs, step.xRefs)
+		}
+		if refs := blobRefs(s.deduper, y); refs != step.yRefs {
+			t.Errorf("%s: y has %d references, want %d", step.name, refs, step.yRefs)
+		}
+		if stats.records != step.xRefs+step.yRefs || stats.blobs != step.blobs {
+			t.Errorf("%s: stats of %d records and %d blobs, want %d and %d",
+				step.name, stats.records, stats.blobs, step.xRefs+step.yRefs, step.blobs)
+		}
+
+		// counts of loaded backend are the same, so no blob is leaked or removed too early
+		keys, err := s.deduper.Backend.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored int64
+		for _, key := range keys {
+			if isBlobID(key) {
+				stored++
+			}
+		}
+		loaded := newDedupingBackend(s.deduper.Backend, s.deduper.settings)
+		if err := loaded.load(); err != nil {
+			t.Fatal(err)
+		}
+		if stored != step.blobs || loaded.currentStats() != stats {
+			t.Errorf("%s: %d stored blobs and loaded stats %+v, want %d and %+v",
+				step.name, stored, loaded.currentStats(), step.blobs, stats)
+		}
+	}
+}
+
+// blobRefs returns count of references of blob of value
+func blobRefs(d *dedupingBackend, raw []byte) int64 {
+	sum := sha256.Sum256(raw)
+	d.blobsMtx.Lock()
+	defer d.blobsMtx.Unlock()
+
+	if b, ok := d.blobs[hex.EncodeToString(sum[:])]; ok {
+		return b.refs
+	}
+	return 0
+}
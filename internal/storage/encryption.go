@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+// encryptionIDPrefix is an id of system record which keeps id of current key after rotation
+const encryptionIDPrefix = systemIDPrefix + "encryption"
+
+// dataKeySize is a size of AES-256 data key which encrypts single value
+const dataKeySize = 32
+
+// Keyring keeps master keys of envelope encryption
+type Keyring struct {
+	// Current is an id of key which encrypts new values until RotateKey
+	Current string `json:"current"`
+	// Keys by id: AES keys of 16, 24 or 32 bytes, base64-encoded in keyfile
+	Keys map[string][]byte `json:"keys"`
+
+	// path of keyfile, keyring is reloaded from it on rotation
+	path string
+}
+
+// LoadKeyring reads keyring from JSON keyfile
+func LoadKeyring(path string) (*Keyring, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k Keyring
+	if err := json.Unmarshal(content, &k); err != nil {
+		return nil, err
+	}
+	if _, ok := k.Keys[k.Current]; !ok {
+		return nil, fmt.Errorf("current key '%s' not found in keyfile", k.Current)
+	}
+	k.path = path
+	return &k, nil
+}
+
+// aeads makes AES-GCM ciphers of master keys
+func (k *Keyring) aeads() (map[string]cipher.AEAD, error) {
+	aeads := make(map[string]cipher.AEAD, len(k.Keys))
+	for id, key := range k.Keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", id, err)
+		}
+		aeads[id] = aead
+	}
+	return aeads, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with random nonce which is prepended to ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// encryptingBackend encrypts values of records on Apply and decrypts them on Get. Every value is encrypted
+// by own random data key, data key is encrypted by master key which id is kept in record.
+// Value is bound to its backend key, so encrypted value of one record can not be substituted by another one
+type encryptingBackend struct {
+	Backend
+
+	aeads map[string]cipher.AEAD
+	// id of master key of new values
+	current string
+
+	// counts of stored records by id of master key, empty id counts plaintext records
+	countsMtx sync.Mutex
+	counts    map[string]int64
+}
+
+func newEncryptingBackend(b Backend, keyring *Keyring) (*encryptingBackend, error) {
+	aeads, err := keyring.aeads()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingBackend{
+		Backend: b,
+		aeads:   aeads,
+		current: keyring.Current,
+		counts:  make(map[string]int64),
+	}, nil
+}
+
+// loadStats counts stored records by master keys
+func (e *encryptingBackend) loadStats() error {
+	keys, err := e.Backend.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r, ok, err := e.Backend.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			e.counts[r.KeyID]++
+		}
+	}
+	return nil
+}
+
+func (e *encryptingBackend) count(keyID string, delta int64) {
+	e.countsMtx.Lock()
+	defer e.countsMtx.Unlock()
+
+	e.counts[keyID] += delta
+	if e.counts[keyID] == 0 {
+		delete(e.counts, keyID)
+	}
+}
+
+func (e *encryptingBackend) Get(id string) (*Record, bool, error) {
+	r, ok, err := e.Backend.Get(id)
+	if err != nil || !ok || r.KeyID == "" {
+		return r, ok, err
+	}
+	dataKey, err := e.dataKey(r)
+	if err != nil {
+		return nil, false, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	raw, err := open(aead, r.Raw, []byte(id))
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypt record '%s': %w", id, err)
+	}
+	decrypted := *r
+	decrypted.Raw = raw
+	decrypted.KeyID = ""
+	decrypted.DataKey = nil
+	return &decrypted, true, nil
+}
+
+// dataKey decrypts data key of record by master key
+func (e *encryptingBackend) dataKey(r *Record) ([]byte, error) {
+	master, ok := e.aeads[r.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key '%s' not found in keyring", r.KeyID)
+	}
+	dataKey, err := open(master, r.DataKey, []byte(r.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func (e *encryptingBackend) Apply(mutations ...Mutation) error {
+	counts := make(map[string]int64)
+	encrypted := make([]Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		old, ok, err := e.Backend.Get(m.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			counts[old.KeyID]--
+		}
+		if m.Record != nil {
+			r, err := e.encrypt(m.ID, m.Record)
+			if err != nil {
+				return err
+			}
+			m.Record = r
+			counts[r.KeyID]++
+		}
+		encrypted = append(encrypted, m)
+	}
+	if err := e.Backend.Apply(encrypted...); err != nil {
+		return err
+	}
+	for keyID, delta := range counts {
+		e.count(keyID, delta)
+	}
+	return nil
+}
+
+// encrypt returns copy of record with value encrypted by new data key
+func (e *encryptingBackend) encrypt(id string, r *Record) (*Record, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := seal(aead, r.Raw, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	encrypted := *r
+	encrypted.Raw = raw
+	return e.wrap(&encrypted, dataKey)
+}
+
+// wrap sets data key of record encrypted by current master key
+func (e *encryptingBackend) wrap(r *Record, dataKey []byte) (*Record, error) {
+	wrapped, err := seal(e.aeads[e.current], dataKey, []byte(e.current))
+	if err != nil {
+		return nil, err
+	}
+	r.KeyID = e.current
+	r.DataKey = wrapped
+	return r, nil
+}
+
+// reencrypt moves record to current master key. Data key of encrypted record is re-encrypted only,
+// plaintext record is encrypted. Caller holds dataMtx and lock of stripe of record
+func (e *encryptingBackend) reencrypt(id string) error {
+	r, ok, err := e.Backend.Get(id)
+	if err != nil || !ok || r.KeyID == e.current {
+		return err
+	}
+	var next *Record
+	if r.KeyID == "" {
+		next, err = e.encrypt(id, r)
+	} else {
+		var dataKey []byte
+		dataKey, err = e.dataKey(r)
+		if err == nil {
+			copied := *r
+			next, err = e.wrap(&copied, dataKey)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := e.Backend.Apply(Mutation{ID: id, Record: next}); err != nil {
+		return err
+	}
+	e.count(r.KeyID, -1)
+	e.count(next.KeyID, 1)
+	return nil
+}
+
+// rotated is a value of system record which keeps id of current key after rotation
+type rotated struct {
+	Current string `json:"current"`
+}
+
+// loadEncryption restores current key of last rotation and resumes re-encryption of records by other keys
+func (c *storageServer) loadEncryption() error {
+	if c.encryptor == nil {
+		return nil
+	}
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	if err := c.encryptor.loadStats(); err != nil {
+		return err
+	}
+	r, ok, err := c.data.Get(encryptionIDPrefix)
+	if err != nil {
+		return err
+	}
+	if ok {
+		var state rotated
+		if err := json.Unmarshal(r.Raw, &state); err != nil {
+			return err
+		}
+		if _, ok := c.encryptor.aeads[state.Current]; !ok {
+			return fmt.Errorf("rotated key '%s' not found in keyring", state.Current)
+		}
+		c.encryptor.current = state.Current
+	}
+	for keyID := range c.encryptor.counts {
+		if keyID != c.encryptor.current {
+			c.rotations <- struct{}{}
+			break
+		}
+	}
+	return nil
+}
+
+func (c *storageServer) RotateKey(ctx context.Context, request *pbAdmin.RotateKeyRequest) (_ *pbAdmin.RotateKeyResponse, err error) {
+	log.Info().Caller().Str("key", request.GetKeyId()).Msg("rotate key")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("rotate key failed")
+		} else {
+			log.Info().Caller().Msg("rotate key done")
+		}
+	}()
+
+	err = c.rotateKey(ctx, request.GetKeyId())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbAdmin.RotateKeyResponse{}, nil
+}
+
+// rotateKey makes key current and starts re-encryption of records in background.
+// Keyring is reloaded from keyfile, so new key may be added without restart
+func (c *storageServer) rotateKey(ctx context.Context, keyID string) error {
+	if c.encryptor == nil {
+		return status.Errorf(codes.FailedPrecondition, "encryption is disabled")
+	}
+	keyring := c.opts.Keyring
+	if keyring.path != "" {
+		reloaded, err := LoadKeyring(keyring.path)
+		if err != nil {
+			return status.Errorf(codes.Internal, "reload keyfile: %s", err.Error())
+		}
+		keyring = reloaded
+	}
+	if _, ok := keyring.Keys[keyID]; !ok {
+		return status.Errorf(codes.InvalidArgument, "key '%s' not found in keyfile", keyID)
+	}
+	aeads, err := keyring.aeads()
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	raw, err := json.Marshal(rotated{Current: keyID})
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+
+	// encryption is local for node, so followers rotate own keys too and rotation is not replicated
+	err = func() error {
+		c.dataMtx.Lock()
+		defer c.dataMtx.Unlock()
+
+		// keys of stored records must stay available
+		for id := range c.encryptor.counts {
+			if _, ok := aeads[id]; !ok && id != "" {
+				return status.Errorf(codes.FailedPrecondition, "key '%s' of stored records not found in keyfile", id)
+			}
+		}
+		previousAEADs, previous := c.encryptor.aeads, c.encryptor.current
+		c.encryptor.aeads, c.encryptor.current = aeads, keyID
+		now := time.Now()
+		err := c.data.Apply(Mutation{ID: encryptionIDPrefix, Record: &Record{
+			Raw:       raw,
+			Version:   1,
+			CreatedAt: now,
+			UpdatedAt: now,
+			CreatedBy: userFromContext(ctx),
+			Size:      uint64(len(raw)),
+		}})
+		if err != nil {
+			c.encryptor.aeads, c.encryptor.current = previousAEADs, previous
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.rotations <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate re-encrypts records by current key in background. Every record is re-encrypted under lock of its stripe
+// only, so requests run meanwhile: backend reads records of old and new keys
+func (c *storageServer) rotate() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.rotations:
+		}
+
+		c.dataMtx.Lock()
+		c.rotating = true
+		// keys of encryptor include blobs which are hidden by deduper
+		keys, err := c.encryptor.Keys()
+		c.dataMtx.Unlock()
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("rotation failed")
+			continue
+		}
+
+		log.Info().Caller().Int("records", len(keys)).Msg("rotation started")
+		for _, key := range keys {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			if err := c.reencrypt(key); err != nil {
+				log.Error().Caller().Str("id", key).Err(err).Msg("re-encrypt failed")
+			}
+		}
+
+		c.dataMtx.Lock()
+		c.rotating = false
+		c.dataMtx.Unlock()
+		log.Info().Caller().Msg("rotation done")
+	}
+}
+
+// reencrypt moves record or blob by backend key to current master key
+func (c *storageServer) reencrypt(key string) error {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	// blobs are written under stripes of deduper
+	locks := c.stripes
+	if isBlobID(key) {
+		locks = c.deduper.locks
+	}
+	stripe := &locks[locks.of(key)]
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	return c.encryptor.reencrypt(key)
+}
+
+func (c *storageServer) EncryptionStats(ctx context.Context, request *pbAdmin.EncryptionStatsRequest) (_ *pbAdmin.EncryptionStatsResponse, err error) {
+	if c.encryptor == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "encryption is disabled")
+	}
+
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+	c.encryptor.countsMtx.Lock()
+	defer c.encryptor.countsMtx.Unlock()
+
+	response := &pbAdmin.EncryptionStatsResponse{
+		CurrentKeyId: c.encryptor.current,
+		RecordsByKey: make(map[string]uint64, len(c.encryptor.counts)),
+		Rotating:     c.rotating,
+	}
+	for keyID, count := range c.encryptor.counts {
+		response.RecordsByKey[keyID] = uint64(count)
+	}
+	return response, nil
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type expiration struct {
+	id string
+	at time.Time
+	// purge is true for purge of tombstone after retention period
+	purge bool
+}
+
+// expirations is a min-heap of record expirations and tombstone purges. Heap may keep stale items
+// of updated, deleted or undeleted records, they are skipped when record is checked on expiration
+type expirations []expiration
+
+func (h expirations) Len() int            { return len(h) }
+func (h expirations) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h expirations) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expirations) Push(x interface{}) { *h = append(*h, x.(expiration)) }
+func (h *expirations) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// schedule adds expiration and wakes up expirer if new expiration is the nearest one
+func (c *storageServer) schedule(e expiration) {
+	c.expirationsMtx.Lock()
+	defer c.expirationsMtx.Unlock()
+
+	heap.Push(&c.expirations, e)
+	if top := c.expirations[0]; top.id == e.id && top.at.Equal(e.at) && top.purge == e.purge {
+		select {
+		case c.expirationsWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due pops expirations which time has come and returns delay until the nearest remaining one
+func (c *storageServer) due(now time.Time) (due []expiration, next time.Duration) {
+	c.expirationsMtx.Lock()
+	defer c.expirationsMtx.Unlock()
+
+	for len(c.expirations) > 0 && !c.expirations[0].at.After(now) {
+		due = append(due, heap.Pop(&c.expirations).(expiration))
+	}
+	if len(c.expirations) == 0 {
+		return due, time.Hour
+	}
+	return due, c.expirations[0].at.Sub(now)
+}
+
+// scheduleRecord schedules expiration of record and purge of tombstone
+func (c *storageServer) scheduleRecord(id string, r *Record) {
+	if !r.ExpiresAt.IsZero() {
+		c.schedule(expiration{id: id, at: r.ExpiresAt})
+	}
+	if r.deleted() {
+		c.schedule(expiration{id: id, at: r.DeletedAt.Add(c.opts.TombstoneRetention), purge: true})
+	}
+}
+
+// expire removes expired records and purges tombstones in background
+func (c *storageServer) expire() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.expirationsWake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		c.dataMtx.RLock()
+		follower := c.leader != ""
+		c.dataMtx.RUnlock()
+		if follower {
+			// follower applies expirations of leader, own ones are processed after promotion
+			continue
+		}
+
+		due, next := c.due(time.Now())
+		for _, e := range due {
+			err := c.write(context.Background(), func(t *tx) error {
+				if e.purge {
+					return t.purgeTombstone(e.id, e.at.Add(-c.opts.TombstoneRetention))
+				}
+				return t.expire(e.id, e.at)
+			})
+			if err != nil {
+				log.Error().Caller().Str("id", e.id).Err(err).Msg("expire failed")
+			}
+		}
+		timer.Reset(next)
+	}
+}
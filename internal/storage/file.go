@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	fileBackendExt     = ".json"
+	fileBackendJournal = "batch.journal"
+	// fileBackendMaxKey is a max length of id which file is named by hex of id, so name of file and its temporary
+	// file fit into 255 bytes
+	fileBackendMaxKey = 100
+	// fileBackendHashed is a prefix of names of files of longer ids
+	fileBackendHashed = "~"
+)
+
+// hashedFile is a content of file of long id: its name is SHA-256 of id, so id is kept with record
+type hashedFile struct {
+	ID     string  `json:"id"`
+	Record *Record `json:"record"`
+}
+
+// fileBackend keeps each record in own file of directory.
+// File name is a hex-encoded record id, so any id is a safe file name. Name of file of id longer
+// than fileBackendMaxKey is SHA-256 of id instead.
+// Multi-record mutations are written into journal first and replayed on open if interrupted
+type fileBackend struct {
+	dir string
+	// journal is single, so multi-record mutations are serialized
+	journalMtx sync.Mutex
+}
+
+func (b *fileBackend) path(id string) string {
+	if hashed(id) {
+		sum := sha256.Sum256([]byte(id))
+		return filepath.Join(b.dir, fileBackendHashed+hex.EncodeToString(sum[:])+fileBackendExt)
+	}
+	return filepath.Join(b.dir, hex.EncodeToString([]byte(id))+fileBackendExt)
+}
+
+// hashed is true if file of id is named by hash of id
+func hashed(id string) bool {
+	return len(id) > fileBackendMaxKey
+}
+
+func (b *fileBackend) Get(id string) (*Record, bool, error) {
+	content, err := os.ReadFile(b.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if hashed(id) {
+		var f hashedFile
+		if err := json.Unmarshal(content, &f); err != nil {
+			return nil, false, fmt.Errorf("decode record '%s': %w", id, err)
+		}
+		if f.ID != id || f.Record == nil {
+			return nil, false, fmt.Errorf("file of record '%s' keeps record '%s'", id, f.ID)
+		}
+		return f.Record, true, nil
+	}
+	var r Record
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, false, fmt.Errorf("decode record '%s': %w", id, err)
+	}
+	return &r, true, nil
+}
+
+func (b *fileBackend) Apply(mutations ...Mutation) error {
+	if len(mutations) == 1 {
+		return b.apply(mutations[0])
+	}
+
+	content, err := json.Marshal(mutations)
+	if err != nil {
+		return err
+	}
+	b.journalMtx.Lock()
+	defer b.journalMtx.Unlock()
+
+	journal := filepath.Join(b.dir, fileBackendJournal)
+	if err := writeFileSync(journal, content); err != nil {
+		return err
+	}
+
+	return b.replay(journal, mutations)
+}
+
+// replay applies journaled mutations and removes journal. Mutations are idempotent,
+// so interrupted replay may be repeated
+func (b *fileBackend) replay(journal string, mutations []Mutation) error {
+	for _, m := range mutations {
+		if err := b.apply(m); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(journal); err != nil {
+		return err
+	}
+	return syncDir(b.dir)
+}
+
+func (b *fileBackend) apply(m Mutation) error {
+	if m.Record == nil {
+		if err := os.Remove(b.path(m.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return syncDir(b.dir)
+	}
+	var v interface{} = m.Record
+	if hashed(m.ID) {
+		v = hashedFile{ID: m.ID, Record: m.Record}
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(b.path(m.ID), content)
+}
+
+func (b *fileBackend) Keys() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != fileBackendExt {
+			continue
+		}
+		if strings.HasPrefix(name, fileBackendHashed) {
+			content, err := os.ReadFile(filepath.Join(b.dir, name))
+			if err != nil {
+				return nil, err
+			}
+			var f hashedFile
+			if err := json.Unmarshal(content, &f); err != nil {
+				return nil, fmt.Errorf("decode file '%s': %w", name, err)
+			}
+			ids = append(ids, f.ID)
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, fileBackendExt))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, string(id))
+	}
+	return ids, nil
+}
+
+func (b *fileBackend) Close() error {
+	return nil
+}
+
+// writeFileSync atomically replaces file content: data is written into temporary file
+// which is synced and renamed over the target
+func writeFileSync(path string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// NewFileBackend makes backend which keeps records in files of dir
+func NewFileBackend(dir string) (*fileBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// temporary files are left by interrupted writes only
+	tmp, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tmp {
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+	b := &fileBackend{
+		dir: dir,
+	}
+	journal := filepath.Join(dir, fileBackendJournal)
+	content, err := os.ReadFile(journal)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var mutations []Mutation
+		if err := json.Unmarshal(content, &mutations); err != nil {
+			return nil, fmt.Errorf("decode journal: %w", err)
+		}
+		if err := b.replay(journal, mutations); err != nil {
+			return nil, fmt.Errorf("replay journal: %w", err)
+		}
+	}
+	return b, nil
+}
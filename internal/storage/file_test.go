@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFileBackendKeys(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", maxIDLength)
+	keys := []string{
+		"short",
+		strings.Repeat("a", fileBackendMaxKey),
+		strings.Repeat("b", fileBackendMaxKey+1),
+		recordKey(strings.Repeat("c", maxCollectionNameLength), long),
+		versionID(recordKey("c", long), 1),
+	}
+	for _, key := range keys {
+		if err := b.Apply(Mutation{ID: key, Record: &Record{Raw: []byte(key), Version: 1}}); err != nil {
+			t.Fatalf("apply %d bytes: %v", len(key), err)
+		}
+	}
+	// multi-record mutations are journaled
+	if err := b.Apply(Mutation{ID: keys[0]}, Mutation{ID: keys[2]}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key  string
+		kept bool
+	}{
+		{key: keys[0], kept: false},
+		{key: keys[1], kept: true},
+		{key: keys[2], kept: false},
+		{key: keys[3], kept: true},
+		{key: keys[4], kept: true},
+	}
+	for _, tt := range tests {
+		r, ok, err := b.Get(tt.key)
+		if err != nil || ok != tt.kept || ok && string(r.Raw) != tt.key {
+			t.Fatalf("get %d bytes: %v %v %v", len(tt.key), r, ok, err)
+		}
+	}
+	got, err := b.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{keys[1], keys[3], keys[4]}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("keys %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// historyIDPrefix is a prefix of system records which list past versions of records
+const historyIDPrefix = systemIDPrefix + "history:"
+
+// versionIDPrefix is a prefix of system records which keep past versions of records. Every version is kept
+// in own record, so writes do not rewrite values of kept versions
+const versionIDPrefix = systemIDPrefix + "version:"
+
+// history is a value of history record: past versions of record without values in ascending order.
+// Version is valid since its UpdatedAt until UpdatedAt of next version, tombstones are versions too
+type history []*Record
+
+// versionID returns id of record of past version of record by backend key
+func versionID(key string, version uint64) string {
+	return fmt.Sprintf("%s%020d:%s", versionIDPrefix, version, key)
+}
+
+// versionOwner returns backend key of record which past version is kept by version record
+func versionOwner(id string) (string, bool) {
+	if !strings.HasPrefix(id, versionIDPrefix) || len(id) < len(versionIDPrefix)+21 {
+		return "", false
+	}
+	// version is fixed-width, so key follows it and colon
+	return id[len(versionIDPrefix)+21:], true
+}
+
+// historyOwner returns backend key of record which history or past version is kept by system record
+func historyOwner(id string) (string, bool) {
+	if strings.HasPrefix(id, historyIDPrefix) {
+		return strings.TrimPrefix(id, historyIDPrefix), true
+	}
+	return versionOwner(id)
+}
+
+// loadHistory returns past versions of record by backend key. Caller holds dataMtx
+func (c *storageServer) loadHistory(key string) (*Record, history, error) {
+	r, ok, err := c.data.Get(historyIDPrefix + key)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	var h history
+	if err := json.Unmarshal(r.Raw, &h); err != nil {
+		return nil, nil, err
+	}
+	return r, h, nil
+}
+
+// trim drops versions over depth and versions superseded before now - maxAge.
+// next is a version which supersedes last version of history
+func (h history) trim(depth int, maxAge time.Duration, next *Record, now time.Time) history {
+	for len(h) > 0 {
+		if len(h) <= depth {
+			supersededAt := next.UpdatedAt
+			if len(h) > 1 {
+				supersededAt = h[1].UpdatedAt
+			}
+			if maxAge <= 0 || !supersededAt.Before(now.Add(-maxAge)) {
+				break
+			}
+		}
+		h = h[1:]
+	}
+	return h
+}
+
+// archive stages replaced versions of records modified by transaction into version records and lists them
+// in history records. Dropped versions and history of removed record are removed too. Caller holds dataMtx
+func (c *storageServer) archive(t *tx) error {
+	if c.opts.HistoryDepth <= 0 {
+		return nil
+	}
+	keys := append([]string(nil), t.order...)
+	for _, key := range keys {
+		if isSystemID(key) {
+			continue
+		}
+		hr, h, err := c.loadHistory(key)
+		if err != nil {
+			return err
+		}
+		r := t.staged[key]
+		old, ok, err := c.data.Get(key)
+		if err != nil {
+			return err
+		}
+		// removed record, expired record and record which is created again start new history
+		if r == nil || !ok || old.expired(t.now) || r.Version <= old.Version {
+			if hr != nil {
+				t.putKey(historyIDPrefix+key, nil)
+				for _, v := range h {
+					t.putKey(versionID(key, v.Version), nil)
+				}
+			}
+			continue
+		}
+
+		past := *old
+		past.Raw = nil
+		all := append(h, &past)
+		h = all.trim(c.opts.HistoryDepth, c.opts.HistoryMaxAge, r, t.now)
+		// trim drops the oldest versions
+		for _, v := range all[:len(all)-len(h)] {
+			t.putKey(versionID(key, v.Version), nil)
+		}
+		if len(h) > 0 {
+			t.putKey(versionID(key, old.Version), old)
+		}
+		raw, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		next := &Record{
+			Raw:       raw,
+			Version:   1,
+			CreatedAt: t.now,
+			UpdatedAt: t.now,
+			Size:      uint64(len(raw)),
+		}
+		if hr != nil {
+			next.Version = hr.Version + 1
+			next.CreatedAt = hr.CreatedAt
+		}
+		t.putKey(historyIDPrefix+key, next)
+	}
+	return nil
+}
+
+// versions returns current version and kept past versions of record in descending order.
+// Past versions are returned without values, loadVersion reads them
+func (c *storageServer) versions(ctx context.Context, id string) ([]*Record, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	name := collectionFromContext(ctx)
+	if _, err := c.collection(name); err != nil {
+		return nil, err
+	}
+	key := recordKey(name, id)
+	// record and its history are written together under lock of their stripe
+	stripe := &c.stripes[c.stripes.of(key)]
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	now := time.Now()
+	r, ok, err := c.data.Get(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	if !ok || r.expired(now) {
+		return nil, status.Errorf(codes.NotFound, "")
+	}
+	_, h, err := c.loadHistory(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	// history is trimmed by age on writes only, so old versions of rarely updated records are skipped here
+	h = h.trim(len(h), c.opts.HistoryMaxAge, r, now)
+
+	versions := make([]*Record, 0, len(h)+1)
+	versions = append(versions, r)
+	for i := len(h) - 1; i >= 0; i-- {
+		versions = append(versions, h[i])
+	}
+	return versions, nil
+}
+
+func (c *storageServer) ListVersions(ctx context.Context, request *pbCRUD.ListVersionsRequest) (_ *pbCRUD.ListVersionsResponse, err error) {
+	log.Info().Caller().Msg("list versions")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("list versions failed")
+		} else {
+			log.Info().Caller().Msg("list versions done")
+		}
+	}()
+
+	versions, err := c.versions(ctx, request.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &pbCRUD.ListVersionsResponse{Versions: make([]*pbCRUD.Version, 0, len(versions))}
+	for _, r := range versions {
+		response.Versions = append(response.Versions, &pbCRUD.Version{
+			Version:  r.Version,
+			Metadata: r.metadata(),
+		})
+	}
+	return response, nil
+}
+
+func (c *storageServer) ReadVersion(ctx context.Context, request *pbCRUD.ReadVersionRequest) (_ *pbCRUD.ReadResponse, err error) {
+	log.Info().Caller().Msg("read version")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("read version failed")
+		} else {
+			log.Info().Caller().Msg("read version done")
+		}
+	}()
+
+	versions, err := c.versions(ctx, request.GetId())
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range versions {
+		if r.Version != request.GetVersion() {
+			continue
+		}
+		// tombstone keeps body of deleted record, but it is not a version of value
+		if r.deleted() {
+			return nil, status.Errorf(codes.NotFound, "version %d is deleted", r.Version)
+		}
+		if i > 0 {
+			if r, err = c.loadVersion(ctx, request.GetId(), r.Version); err != nil {
+				return nil, err
+			}
+		}
+		return versionResponse(r), nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "version %d not found", request.GetVersion())
+}
+
+// loadVersion returns past version of record with value. Version may be dropped by write after it is listed,
+// it is not found then
+func (c *storageServer) loadVersion(ctx context.Context, id string, version uint64) (*Record, error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	r, ok, err := c.data.Get(versionID(recordKey(collectionFromContext(ctx), id), version))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "version %d not found", version)
+	}
+	return r, nil
+}
+
+// versionResponse is a read response of version without remaining time to live
+func versionResponse(r *Record) *pbCRUD.ReadResponse {
+	return &pbCRUD.ReadResponse{Raw: r.Raw, Version: r.Version, Metadata: r.metadata()}
+}
+
+// readAt returns version of record which was valid at the time
+func (c *storageServer) readAt(ctx context.Context, id string, at time.Time) (*pbCRUD.ReadResponse, error) {
+	versions, err := c.versions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range versions {
+		if r.UpdatedAt.After(at) {
+			continue
+		}
+		if r.deleted() || r.expired(at) {
+			break
+		}
+		if i == 0 {
+			return readResponse(r), nil
+		}
+		r, err := c.loadVersion(ctx, id, r.Version)
+		if err != nil {
+			return nil, err
+		}
+		return versionResponse(r), nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "")
+}
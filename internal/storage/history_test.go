@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+func TestCreateOverTombstone(t *testing.T) {
+	s, err := New(NewMemoryBackend(), Options{TombstoneRetention: time.Hour, HistoryDepth: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	if _, err := s.Create(ctx, &pbCRUD.CreateRequest{Id: "a", Raw: []byte(`"first"`)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Delete(ctx, &pbCRUD.DeleteRequest{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// tombstone is a current version of record
+	if _, err := s.ReadVersion(ctx, &pbCRUD.ReadVersionRequest{Id: "a", Version: 2}); status.Code(err) != codes.NotFound {
+		t.Fatalf("read version of tombstone: %v, want NotFound", err)
+	}
+	created, err := s.Create(ctx, &pbCRUD.CreateRequest{Id: "a", Raw: []byte(`"second"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetVersion() != 3 {
+		t.Fatalf("version of created record %d, want 3", created.GetVersion())
+	}
+
+	tests := []struct {
+		version uint64
+		raw     string
+		code    codes.Code
+	}{
+		{version: 1, raw: `"first"`},
+		{version: 2, code: codes.NotFound},
+		{version: 3, raw: `"second"`},
+		{version: 4, code: codes.NotFound},
+	}
+	for _, test := range tests {
+		response, err := s.ReadVersion(ctx, &pbCRUD.ReadVersionRequest{Id: "a", Version: test.version})
+		if status.Code(err) != test.code {
+			t.Errorf("read version %d: %v, want %v", test.version, err, test.code)
+			continue
+		}
+		if err == nil && string(response.GetRaw()) != test.raw {
+			t.Errorf("read version %d: %s, want %s", test.version, response.GetRaw(), test.raw)
+		}
+	}
+}
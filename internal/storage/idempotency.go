@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idempotencyIDPrefix is a prefix of ids of system records which keep results of create requests
+// with idempotency keys. Records expire after retention period, so they are persisted and replicated with data
+const idempotencyIDPrefix = systemIDPrefix + "idempotency:"
+
+type idempotencyResult struct {
+	ID      string `json:"id"`
+	Version uint64 `json:"version"`
+}
+
+// idempotencyID returns id of record of idempotency key. Keys are scoped by user and collection,
+// so same key of different users or collections does not collide
+func idempotencyID(user, collection, key string) string {
+	return idempotencyIDPrefix + user + "\x00" + collection + "\x00" + key
+}
+
+// idempotencyResult returns remembered result of create request with idempotency key
+func (t *tx) idempotencyResult(key string) (idempotencyResult, bool, error) {
+	r, ok, err := t.get(idempotencyID(t.user, t.collection, key))
+	if err != nil || !ok {
+		return idempotencyResult{}, false, err
+	}
+	var result idempotencyResult
+	if err := json.Unmarshal(r.Raw, &result); err != nil {
+		return idempotencyResult{}, false, status.Errorf(codes.Internal, err.Error())
+	}
+	return result, true, nil
+}
+
+// rememberResult stages record of result of create request with idempotency key until end of retention
+func (t *tx) rememberResult(key string, result idempotencyResult) error {
+	if t.idempotencyRetention <= 0 {
+		return nil
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	t.put(idempotencyID(t.user, t.collection, key), &Record{
+		Raw:       raw,
+		Version:   1,
+		CreatedAt: t.now,
+		UpdatedAt: t.now,
+		ExpiresAt: t.now.Add(t.idempotencyRetention),
+		Size:      uint64(len(raw)),
+	})
+	return nil
+}
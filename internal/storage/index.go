@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// indexIDPrefix is a prefix of system records which keep index definitions
+const indexIDPrefix = systemIDPrefix + "index:"
+
+// kinds of indexed values in sort order
+const (
+	kindNull = iota
+	kindBool
+	kindNumber
+	kindString
+)
+
+// indexValue is a scalar JSON value. Values of different kinds are ordered by kind
+type indexValue struct {
+	kind int
+	b    bool
+	num  float64
+	str  string
+}
+
+func (v indexValue) compare(other indexValue) int {
+	if v.kind != other.kind {
+		return v.kind - other.kind
+	}
+	switch v.kind {
+	case kindBool:
+		switch {
+		case v.b == other.b:
+			return 0
+		case !v.b:
+			return -1
+		default:
+			return 1
+		}
+	case kindNumber:
+		switch {
+		case v.num < other.num:
+			return -1
+		case v.num > other.num:
+			return 1
+		default:
+			return 0
+		}
+	case kindString:
+		return strings.Compare(v.str, other.str)
+	default:
+		return 0
+	}
+}
+
+// indexValueOf converts decoded JSON scalar. ok is false for objects and arrays
+func indexValueOf(v interface{}) (_ indexValue, ok bool) {
+	switch v := v.(type) {
+	case nil:
+		return indexValue{kind: kindNull}, true
+	case bool:
+		return indexValue{kind: kindBool, b: v}, true
+	case float64:
+		return indexValue{kind: kindNumber, num: v}, true
+	case string:
+		return indexValue{kind: kindString, str: v}, true
+	default:
+		return indexValue{}, false
+	}
+}
+
+func indexValueOfProto(v *structpb.Value) (indexValue, error) {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_NullValue:
+		return indexValue{kind: kindNull}, nil
+	case *structpb.Value_BoolValue:
+		return indexValue{kind: kindBool, b: k.BoolValue}, nil
+	case *structpb.Value_NumberValue:
+		if math.IsNaN(k.NumberValue) {
+			return indexValue{}, status.Errorf(codes.InvalidArgument, "NaN is not comparable")
+		}
+		return indexValue{kind: kindNumber, num: k.NumberValue}, nil
+	case *structpb.Value_StringValue:
+		return indexValue{kind: kindString, str: k.StringValue}, nil
+	default:
+		return indexValue{}, status.Errorf(codes.InvalidArgument, "only scalar values are comparable")
+	}
+}
+
+// extract returns value of JSON document at dot-separated path. Numeric path segments address array items
+func extract(raw []byte, path []string) (indexValue, bool) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return indexValue{}, false
+	}
+	for _, segment := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[segment]
+			if !ok {
+				return indexValue{}, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return indexValue{}, false
+			}
+			doc = node[i]
+		default:
+			return indexValue{}, false
+		}
+	}
+	return indexValueOf(doc)
+}
+
+type indexEntry struct {
+	value indexValue
+	id    string
+}
+
+func (e indexEntry) compare(other indexEntry) int {
+	if c := e.value.compare(other.value); c != 0 {
+		return c
+	}
+	return strings.Compare(e.id, other.id)
+}
+
+// index keeps ids of records ordered by value at path. Entries are guarded by own mutex,
+// so writes update different indexes in parallel
+type index struct {
+	name string
+	path string
+
+	segments []string
+	mtx      sync.Mutex
+	entries  []indexEntry
+	byID     map[string]indexValue
+}
+
+func newIndex(name, path string) *index {
+	return &index{
+		name:     name,
+		path:     path,
+		segments: strings.Split(path, "."),
+		byID:     make(map[string]indexValue),
+	}
+}
+
+// update reindexes record, nil record removes it from index
+func (idx *index) update(id string, r *Record) {
+	// value is extracted before lock
+	var (
+		v       indexValue
+		indexed bool
+	)
+	if r != nil {
+		v, indexed = extract(r.Raw, idx.segments)
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	if old, ok := idx.byID[id]; ok {
+		e := indexEntry{value: old, id: id}
+		i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].compare(e) >= 0 })
+		if i < len(idx.entries) && idx.entries[i] == e {
+			idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+		}
+		delete(idx.byID, id)
+	}
+	if !indexed {
+		return
+	}
+	e := indexEntry{value: v, id: id}
+	i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].compare(e) >= 0 })
+	idx.entries = append(idx.entries, indexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = e
+	idx.byID[id] = v
+}
+
+// match returns ids of records which indexed value satisfies predicate
+func (idx *index) match(op pbCRUD.Predicate_Operator, v indexValue) map[string]struct{} {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// entries with value lower than v are before lo, entries with value greater than v are since hi
+	lo := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].value.compare(v) >= 0 })
+	hi := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].value.compare(v) > 0 })
+
+	var from, to int
+	switch op {
+	case pbCRUD.Predicate_Eq:
+		from, to = lo, hi
+	case pbCRUD.Predicate_Lt:
+		from, to = 0, lo
+	case pbCRUD.Predicate_Lte:
+		from, to = 0, hi
+	case pbCRUD.Predicate_Gt:
+		from, to = hi, len(idx.entries)
+	case pbCRUD.Predicate_Gte:
+		from, to = lo, len(idx.entries)
+	}
+	// range predicates do not cross kinds: "a" is not greater than 1
+	ids := make(map[string]struct{}, to-from)
+	for _, e := range idx.entries[from:to] {
+		if e.value.kind == v.kind {
+			ids[e.id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+type indexDefinition struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func validateIndex(name, path string) error {
+	if name == "" {
+		return status.Errorf(codes.InvalidArgument, "empty index name")
+	}
+	if path == "" {
+		return status.Errorf(codes.InvalidArgument, "empty index path")
+	}
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return status.Errorf(codes.InvalidArgument, "empty segment of index path '%s'", path)
+		}
+	}
+	return nil
+}
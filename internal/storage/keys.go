@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// recordKeysLevels is a max count of levels of skip list of record keys, enough for 4^24 keys
+const recordKeysLevels = 24
+
+type keyNode struct {
+	collection string
+	id         string
+	next       []*keyNode
+}
+
+// less is true if node is ordered before record of collection with id
+func (n *keyNode) less(collection, id string) bool {
+	return n.collection < collection || n.collection == collection && n.id < id
+}
+
+// recordKeys keeps keys of records ordered by collection and id, so list reads page from its cursor
+// without scan of backend. Keys of tombstones and expired records are kept until they are removed from backend.
+// It is a skip list guarded by own mutex, because writes of different stripes apply mutations concurrently
+type recordKeys struct {
+	mtx   sync.RWMutex
+	head  keyNode
+	level int
+}
+
+func newRecordKeys() *recordKeys {
+	return &recordKeys{
+		head:  keyNode{next: make([]*keyNode, recordKeysLevels)},
+		level: 1,
+	}
+}
+
+// seek returns first node which is not less than record of collection with id. If update is not nil,
+// it gets last nodes before that node at every level
+func (k *recordKeys) seek(collection, id string, update []*keyNode) *keyNode {
+	n := &k.head
+	for l := k.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].less(collection, id) {
+			n = n.next[l]
+		}
+		if update != nil {
+			update[l] = n
+		}
+	}
+	return n.next[0]
+}
+
+// add adds key of record in backend, system keys are ignored
+func (k *recordKeys) add(key string) {
+	if isSystemID(key) {
+		return
+	}
+	collection, id := splitKey(key)
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	var update [recordKeysLevels]*keyNode
+	if n := k.seek(collection, id, update[:]); n != nil && n.collection == collection && n.id == id {
+		return
+	}
+	// every next level has a quarter of nodes of previous one
+	level := bits.TrailingZeros64(rand.Uint64()|1<<(2*recordKeysLevels-2))/2 + 1
+	for ; k.level < level; k.level++ {
+		update[k.level] = &k.head
+	}
+	n := &keyNode{collection: collection, id: id, next: make([]*keyNode, level)}
+	for l := 0; l < level; l++ {
+		n.next[l] = update[l].next[l]
+		update[l].next[l] = n
+	}
+}
+
+// remove removes key of record in backend
+func (k *recordKeys) remove(key string) {
+	if isSystemID(key) {
+		return
+	}
+	collection, id := splitKey(key)
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	var update [recordKeysLevels]*keyNode
+	n := k.seek(collection, id, update[:])
+	if n == nil || n.collection != collection || n.id != id {
+		return
+	}
+	for l := 0; l < k.level && update[l].next[l] == n; l++ {
+		update[l].next[l] = n.next[l]
+	}
+	for k.level > 1 && k.head.next[k.level-1] == nil {
+		k.level--
+	}
+}
+
+// after returns up to limit ids of records of collection with prefix which are greater than after, in ascending order
+func (k *recordKeys) after(collection, prefix, after string, limit int) []string {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	from := after
+	if prefix > from {
+		from = prefix
+	}
+	var ids []string
+	for n := k.seek(collection, from, nil); n != nil && len(ids) < limit; n = n.next[0] {
+		// ids with prefix are adjacent, so the first id without it ends the range
+		if n.collection != collection || !strings.HasPrefix(n.id, prefix) {
+			break
+		}
+		if n.id != after {
+			ids = append(ids, n.id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRecordKeys(t *testing.T) {
+	k := newRecordKeys()
+	kept := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		collection := []string{"", "a", "b"}[rnd.Intn(3)]
+		key := recordKey(collection, fmt.Sprintf("%c%03d", 'p'+rnd.Intn(3), rnd.Intn(500)))
+		if rnd.Intn(3) == 0 {
+			k.remove(key)
+			delete(kept, key)
+		} else {
+			k.add(key)
+			kept[key] = true
+		}
+	}
+	// system keys are not records
+	k.add(collectionIDPrefix + "a")
+	k.add(versionID("a", 1))
+
+	want := func(collection, prefix, after string, limit int) []string {
+		var ids []string
+		for key := range kept {
+			c, id := splitKey(key)
+			if c == collection && id > after && strings.HasPrefix(id, prefix) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		if len(ids) > limit {
+			ids = ids[:limit]
+		}
+		return ids
+	}
+	tests := []struct {
+		name       string
+		collection string
+		prefix     string
+		after      string
+		limit      int
+	}{
+		{name: "first page of default collection", limit: 10},
+		{name: "first page of named collection", collection: "a", limit: 10},
+		{name: "whole collection", collection: "b", limit: 100000},
+		{name: "page after cursor", collection: "a", after: "q250", limit: 7},
+		{name: "cursor between keys", after: "q250x", limit: 7},
+		{name: "prefix", collection: "b", prefix: "q1", limit: 1000},
+		{name: "cursor before prefix", prefix: "r", after: "p999", limit: 5},
+		{name: "cursor inside prefix", prefix: "r", after: "r100", limit: 5},
+		{name: "cursor after prefix", prefix: "p", after: "q", limit: 5},
+		{name: "missing collection", collection: "c", limit: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := k.after(tt.collection, tt.prefix, tt.after, tt.limit)
+			if w := want(tt.collection, tt.prefix, tt.after, tt.limit); !reflect.DeepEqual(got, w) {
+				t.Fatalf("got %v, want %v", got, w)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryShards is a count of shards of memory backend, writes of keys of different shards run in parallel
+const memoryShards = 64
+
+type memoryShard struct {
+	mtx  sync.RWMutex
+	data map[string]*Record
+}
+
+// memoryBackend keeps records in maps sharded by hash of id. Apply locks all shards of its mutations,
+// so mutations of one Apply are visible at once
+type memoryBackend struct {
+	shards [memoryShards]memoryShard
+}
+
+func (b *memoryBackend) shard(id string) int {
+	return int(hashKey(id) % memoryShards)
+}
+
+func (b *memoryBackend) Get(id string) (*Record, bool, error) {
+	s := &b.shards[b.shard(id)]
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	r, ok := s.data[id]
+	return r, ok, nil
+}
+
+func (b *memoryBackend) Apply(mutations ...Mutation) error {
+	// shards are locked in ascending order, so concurrent Apply do not deadlock
+	shards := make([]int, 0, len(mutations))
+	for _, m := range mutations {
+		shards = append(shards, b.shard(m.ID))
+	}
+	sort.Ints(shards)
+	for i, n := range shards {
+		if i == 0 || shards[i-1] != n {
+			b.shards[n].mtx.Lock()
+		}
+	}
+	defer func() {
+		for i, n := range shards {
+			if i == 0 || shards[i-1] != n {
+				b.shards[n].mtx.Unlock()
+			}
+		}
+	}()
+
+	for _, m := range mutations {
+		s := &b.shards[b.shard(m.ID)]
+		if m.Record == nil {
+			delete(s.data, m.ID)
+		} else {
+			s.data[m.ID] = m.Record
+		}
+	}
+	return nil
+}
+
+// Keys returns ids of all shards at once
+func (b *memoryBackend) Keys() ([]string, error) {
+	n := 0
+	for i := range b.shards {
+		b.shards[i].mtx.RLock()
+		n += len(b.shards[i].data)
+	}
+	ids := make([]string, 0, n)
+	for i := range b.shards {
+		for id := range b.shards[i].data {
+			ids = append(ids, id)
+		}
+		b.shards[i].mtx.RUnlock()
+	}
+	return ids, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// NewMemoryBackend makes backend which keeps records in memory only
+func NewMemoryBackend() *memoryBackend {
+	b := &memoryBackend{}
+	for i := range b.shards {
+		b.shards[i].data = make(map[string]*Record)
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// maxEventValueSize is a max size of value which is sent in CDC event, larger values are omitted,
+// so events of large uploads fit into default 4 MB message of gRPC
+const maxEventValueSize = 1 << 20
+
+// userMetadataKey is a key of gRPC metadata with name of user on which behalf request is made
+const userMetadataKey = "user"
+
+func userFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if users := md.Get(userMetadataKey); len(users) > 0 {
+		return users[0]
+	}
+	return ""
+}
+
+func (r *Record) metadata() *pbCRUD.Metadata {
+	m := &pbCRUD.Metadata{
+		ContentType: r.ContentType,
+		CreatedAt:   timestamppb.New(r.CreatedAt),
+		UpdatedAt:   timestamppb.New(r.UpdatedAt),
+		CreatedBy:   r.CreatedBy,
+		Size:        r.Size,
+	}
+	if r.deleted() {
+		m.DeletedAt = timestamppb.New(r.DeletedAt)
+	}
+	return m
+}
+
+func (r *Record) cdcMetadata() *pbCDC.Metadata {
+	return &pbCDC.Metadata{
+		ContentType: r.ContentType,
+		CreatedAt:   timestamppb.New(r.CreatedAt),
+		UpdatedAt:   timestamppb.New(r.UpdatedAt),
+		CreatedBy:   r.CreatedBy,
+		Size:        r.Size,
+	}
+}
+
+// cdcData is data of CDC event about record, value larger than maxEventValueSize is omitted
+func (r *Record) cdcData(id string) *pbCDC.Data {
+	data := &pbCDC.Data{
+		Id:       id,
+		Version:  r.Version,
+		Metadata: r.cdcMetadata(),
+	}
+	if len(r.Raw) > maxEventValueSize {
+		data.RawOmitted = true
+	} else {
+		data.Raw = r.Raw
+	}
+	return data
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+var (
+	errPathNotFound = errors.New("path not found")
+	errTestFailed   = errors.New("test failed")
+)
+
+// jsonPatchOperation is an operation of RFC 6902 JSON Patch
+type jsonPatchOperation struct {
+	Op   string  `json:"op"`
+	Path *string `json:"path"`
+	From *string `json:"from"`
+	// Value keeps null as is, so missing value is empty
+	Value json.RawMessage `json:"value"`
+}
+
+// applyPatch returns JSON document changed by patch of format
+func applyPatch(raw []byte, format pbCRUD.PatchRequest_PatchFormat, patch []byte) ([]byte, error) {
+	doc, err := decodeJSON(raw)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "record is not a JSON document: %s", err.Error())
+	}
+
+	switch format {
+	case pbCRUD.PatchRequest_JsonPatch:
+		var operations []jsonPatchOperation
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong patch: %s", err.Error())
+		}
+		for i, op := range operations {
+			if doc, err = op.apply(doc); err != nil {
+				// failed test is a failed precondition of whole patch like version mismatch
+				if errors.Is(err, errTestFailed) {
+					return nil, status.Errorf(codes.FailedPrecondition, "patch operation %d: %s", i, err.Error())
+				}
+				return nil, status.Errorf(codes.InvalidArgument, "patch operation %d: %s", i, err.Error())
+			}
+		}
+	case pbCRUD.PatchRequest_MergePatch:
+		p, err := decodeJSON(patch)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "wrong patch: %s", err.Error())
+		}
+		doc = mergePatch(doc, p)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown patch format %d", format)
+	}
+
+	return encodeJSON(doc)
+}
+
+func (op jsonPatchOperation) apply(doc interface{}) (_ interface{}, err error) {
+	defer func() {
+		if !errors.Is(err, errPathNotFound) {
+			return
+		}
+		if op.From != nil {
+			err = fmt.Errorf("%s from '%s' to '%s': %w", op.Op, *op.From, *op.Path, err)
+		} else {
+			err = fmt.Errorf("%s '%s': %w", op.Op, *op.Path, err)
+		}
+	}()
+	if op.Path == nil {
+		return nil, errors.New("path is missing")
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New("value is missing")
+		}
+		value, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return jsonAdd(doc, path, value)
+		case "replace":
+			if doc, _, err = jsonRemove(doc, path); err != nil {
+				return nil, err
+			}
+			return jsonAdd(doc, path, value)
+		default:
+			actual, err := jsonGet(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !jsonEqual(actual, value) {
+				return nil, fmt.Errorf("test of '%s': %w", *op.Path, errTestFailed)
+			}
+			return doc, nil
+		}
+	case "remove":
+		doc, _, err = jsonRemove(doc, path)
+		return doc, err
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New("from is missing")
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Op == "move" {
+			if strings.HasPrefix(*op.Path, *op.From+"/") {
+				return nil, errors.New("value cannot be moved into its child")
+			}
+			if doc, value, err = jsonRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = jsonGet(doc, from); err != nil {
+				return nil, err
+			}
+			value = jsonCopy(value)
+		}
+		return jsonAdd(doc, path, value)
+	default:
+		return nil, fmt.Errorf("unknown operation '%s'", op.Op)
+	}
+}
+
+// mergePatch applies RFC 7396 merge patch to document
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = make(map[string]interface{}, len(p))
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(target, name)
+		} else {
+			target[name] = mergePatch(target[name], value)
+		}
+	}
+	return target
+}
+
+// parsePointer returns reference tokens of RFC 6901 JSON pointer
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("wrong path '%s'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token of array element, index of element past the end is allowed for adding only
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+	// leading zeros are not allowed by RFC 6901
+	if token == "" || len(token) > 1 && token[0] == '0' {
+		return 0, errPathNotFound
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || i == length && !adding {
+		return 0, errPathNotFound
+	}
+	return i, nil
+}
+
+func jsonGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// jsonAdd adds value at path and returns changed document
+func jsonAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if last {
+			node[token] = value
+			return node, nil
+		}
+		child, ok := node[token]
+		if !ok {
+			return nil, errPathNotFound
+		}
+		child, err := jsonAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		if node[i], err = jsonAdd(node[i], path[1:], value); err != nil {
+			return nil, err
+		}
+		return node, nil
+	default:
+		return nil, errPathNotFound
+	}
+}
+
+// jsonRemove removes value at path and returns changed document and removed value
+func jsonRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, errPathNotFound
+		}
+		if last {
+			delete(node, token)
+			return node, child, nil
+		}
+		child, removed, err := jsonRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[token] = child
+		return node, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := node[i]
+			return append(node[:i], node[i+1:]...), removed, nil
+		}
+		child, removed, err := jsonRemove(node[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		node[i] = child
+		return node, removed, nil
+	default:
+		return nil, nil, errPathNotFound
+	}
+}
+
+func jsonCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for name, value := range v {
+			c[name] = jsonCopy(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = jsonCopy(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// jsonEqual compares JSON values, numbers are equal if their values are equal
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, value := range a {
+			other, ok := b[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
+
+// decodeJSON decodes single JSON value, numbers are kept as is
+func decodeJSON(raw []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("data after top-level value")
+	}
+	return v, nil
+}
+
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+func TestApplyPatch(t *testing.T) {
+	const (
+		jsonPatch  = pbCRUD.PatchRequest_JsonPatch
+		mergePatch = pbCRUD.PatchRequest_MergePatch
+	)
+
+	tests := []struct {
+		name   string
+		doc    string
+		format pbCRUD.PatchRequest_PatchFormat
+		patch  string
+		// want is compared as JSON value if code is OK
+		want string
+		code codes.Code
+	}{
+		// examples of appendix A of RFC 6902
+		{name: "A.1 add object member", doc: `{"foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/baz","value":"qux"}]`, want: `{"baz":"qux","foo":"bar"}`},
+		{name: "A.2 add array element", doc: `{"foo":["bar","baz"]}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, want: `{"foo":["bar","qux","baz"]}`},
+		{name: "A.3 remove object member", doc: `{"baz":"qux","foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"remove","path":"/baz"}]`, want: `{"foo":"bar"}`},
+		{name: "A.4 remove array element", doc: `{"foo":["bar","qux","baz"]}`, format: jsonPatch,
+			patch: `[{"op":"remove","path":"/foo/1"}]`, want: `{"foo":["bar","baz"]}`},
+		{name: "A.5 replace value", doc: `{"baz":"qux","foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, want: `{"baz":"boo","foo":"bar"}`},
+		{name: "A.6 move value", doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, format: jsonPatch,
+			patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{name: "A.7 move array element", doc: `{"foo":["all","grass","cows","eat"]}`, format: jsonPatch,
+			patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, want: `{"foo":["all","cows","eat","grass"]}`},
+		{name: "A.8 test value success", doc: `{"baz":"qux","foo":["a",2,"c"]}`, format: jsonPatch,
+			patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			want:  `{"baz":"qux","foo":["a",2,"c"]}`},
+		{name: "A.9 test value error", doc: `{"baz":"qux"}`, format: jsonPatch,
+			patch: `[{"op":"test","path":"/baz","value":"bar"}]`, code: codes.FailedPrecondition},
+		{name: "A.10 add nested member object", doc: `{"foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			want:  `{"foo":"bar","child":{"grandchild":{}}}`},
+		{name: "A.11 ignore unrecognized elements", doc: `{"foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, want: `{"foo":"bar","baz":"qux"}`},
+		{name: "A.12 add to nonexistent target", doc: `{"foo":"bar"}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, code: codes.InvalidArgument},
+		{name: "A.14 escape ordering", doc: `{"/":9,"~1":10}`, format: jsonPatch,
+			patch: `[{"op":"test","path":"/~01","value":10}]`, want: `{"/":9,"~1":10}`},
+		{name: "A.15 comparing strings and numbers", doc: `{"/":9,"~1":10}`, format: jsonPatch,
+			patch: `[{"op":"test","path":"/~01","value":"10"}]`, code: codes.FailedPrecondition},
+		{name: "A.16 add array value", doc: `{"foo":["bar"]}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, want: `{"foo":["bar",["abc","def"]]}`},
+		{name: "copy value", doc: `{"a":{"b":1}}`, format: jsonPatch,
+			patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`,
+			want:  `{"a":{"b":1},"c":{"b":2}}`},
+		{name: "replace root", doc: `{"a":1}`, format: jsonPatch,
+			patch: `[{"op":"replace","path":"","value":[1]}]`, want: `[1]`},
+		{name: "numbers are equal by value", doc: `{"a":1}`, format: jsonPatch,
+			patch: `[{"op":"test","path":"/a","value":1.0}]`, want: `{"a":1}`},
+		{name: "patch is applied all or nothing", doc: `{"a":1}`, format: jsonPatch,
+			patch: `[{"op":"remove","path":"/a"},{"op":"remove","path":"/a"}]`, code: codes.InvalidArgument},
+		{name: "replace of missing member", doc: `{"a":1}`, format: jsonPatch,
+			patch: `[{"op":"replace","path":"/b","value":1}]`, code: codes.InvalidArgument},
+		{name: "index past the end", doc: `[1]`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/2","value":1}]`, code: codes.InvalidArgument},
+		{name: "index with leading zero", doc: `[1,2]`, format: jsonPatch,
+			patch: `[{"op":"remove","path":"/01"}]`, code: codes.InvalidArgument},
+		{name: "move into own child", doc: `{"a":{"b":1}}`, format: jsonPatch,
+			patch: `[{"op":"move","from":"/a","path":"/a/c"}]`, code: codes.InvalidArgument},
+		{name: "path without leading slash", doc: `{"a":1}`, format: jsonPatch,
+			patch: `[{"op":"remove","path":"a"}]`, code: codes.InvalidArgument},
+		{name: "missing value", doc: `{}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/a"}]`, code: codes.InvalidArgument},
+		{name: "null value", doc: `{}`, format: jsonPatch,
+			patch: `[{"op":"add","path":"/a","value":null}]`, want: `{"a":null}`},
+		{name: "unknown operation", doc: `{}`, format: jsonPatch,
+			patch: `[{"op":"merge","path":"/a","value":1}]`, code: codes.InvalidArgument},
+		{name: "patch is not an array", doc: `{}`, format: jsonPatch,
+			patch: `{"op":"add","path":"/a","value":1}`, code: codes.InvalidArgument},
+		{name: "record is not JSON", doc: `plain text`, format: jsonPatch,
+			patch: `[]`, code: codes.FailedPrecondition},
+
+		// examples of appendix A of RFC 7396
+		{name: "merge replaces member", doc: `{"a":"b"}`, format: mergePatch, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "merge adds member", doc: `{"a":"b"}`, format: mergePatch, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{name: "merge removes member", doc: `{"a":"b"}`, format: mergePatch, patch: `{"a":null}`, want: `{}`},
+		{name: "merge removes one of members", doc: `{"a":"b","b":"c"}`, format: mergePatch,
+			patch: `{"a":null}`, want: `{"b":"c"}`},
+		{name: "merge replaces array by value", doc: `{"a":["b"]}`, format: mergePatch,
+			patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "merge replaces value by array", doc: `{"a":"c"}`, format: mergePatch,
+			patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{name: "merge recurses into objects", doc: `{"a":{"b":"c"}}`, format: mergePatch,
+			patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{name: "merge replaces arrays", doc: `{"a":[{"b":"c"}]}`, format: mergePatch,
+			patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{name: "merge array over array", doc: `["a","b"]`, format: mergePatch, patch: `["c","d"]`, want: `["c","d"]`},
+		{name: "merge array over object", doc: `{"a":"b"}`, format: mergePatch, patch: `["c"]`, want: `["c"]`},
+		{name: "merge null over object", doc: `{"a":"foo"}`, format: mergePatch, patch: `null`, want: `null`},
+		{name: "merge string over object", doc: `{"a":"foo"}`, format: mergePatch, patch: `"bar"`, want: `"bar"`},
+		{name: "merge keeps null members of document", doc: `{"e":null}`, format: mergePatch,
+			patch: `{"a":1}`, want: `{"e":null,"a":1}`},
+		{name: "merge object over array", doc: `[1,2]`, format: mergePatch,
+			patch: `{"a":"b","c":null}`, want: `{"a":"b"}`},
+		{name: "merge nested null into missing member", doc: `{}`, format: mergePatch,
+			patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+		{name: "merge patch is not JSON", doc: `{}`, format: mergePatch, patch: `{`, code: codes.InvalidArgument},
+
+		{name: "unknown format", doc: `{}`, format: 2, patch: `{}`, code: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := applyPatch([]byte(test.doc), test.format, []byte(test.patch))
+			if status.Code(err) != test.code {
+				t.Fatalf("patch: %v, want %v", err, test.code)
+			}
+			if err != nil {
+				return
+			}
+			actual, err := decodeJSON(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := decodeJSON([]byte(test.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(actual, want) {
+				t.Fatalf("patched %s, want %s", raw, test.want)
+			}
+		})
+	}
+}
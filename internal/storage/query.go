@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+func (c *storageServer) CreateIndex(ctx context.Context, request *pbCRUD.CreateIndexRequest) (_ *pbCRUD.CreateIndexResponse, err error) {
+	log.Info().Caller().Str("index", request.GetIndex().GetName()).Msg("create index")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("create index failed")
+		} else {
+			log.Info().Caller().Msg("create index done")
+		}
+	}()
+
+	err = c.createIndex(ctx, request.GetIndex().GetName(), request.GetIndex().GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.CreateIndexResponse{}, nil
+}
+
+// createIndex stores index definition and builds index over existing records
+func (c *storageServer) createIndex(ctx context.Context, name, path string) error {
+	if err := validateIndex(name, path); err != nil {
+		return err
+	}
+	definition, err := json.Marshal(indexDefinition{Name: name, Path: path})
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+
+	return c.alter(ctx, func(t *tx) error {
+		if _, ok := c.indexes[name]; ok {
+			return status.Errorf(codes.AlreadyExists, "index '%s' already exists", name)
+		}
+		idx, err := c.buildIndex(name, path)
+		if err != nil {
+			return err
+		}
+		t.put(indexIDPrefix+name, &Record{
+			Raw:       definition,
+			Version:   1,
+			CreatedAt: t.now,
+			UpdatedAt: t.now,
+			CreatedBy: t.user,
+			Size:      uint64(len(definition)),
+		})
+		t.commit = append(t.commit, func() {
+			c.indexes[name] = idx
+		})
+		return nil
+	})
+}
+
+// buildIndex indexes all stored records. Caller holds dataMtx for writing
+func (c *storageServer) buildIndex(name, path string) (*index, error) {
+	idx := newIndex(name, path)
+	ids, err := c.data.Keys()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	for _, id := range ids {
+		if isSystemID(id) {
+			continue
+		}
+		r, ok, err := c.data.Get(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		if ok && !r.deleted() {
+			idx.update(id, r)
+		}
+	}
+	return idx, nil
+}
+
+func (c *storageServer) DropIndex(ctx context.Context, request *pbCRUD.DropIndexRequest) (_ *pbCRUD.DropIndexResponse, err error) {
+	log.Info().Caller().Str("index", request.GetName()).Msg("drop index")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("drop index failed")
+		} else {
+			log.Info().Caller().Msg("drop index done")
+		}
+	}()
+
+	err = c.dropIndex(ctx, request.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.DropIndexResponse{}, nil
+}
+
+func (c *storageServer) dropIndex(ctx context.Context, name string) error {
+	return c.alter(ctx, func(t *tx) error {
+		if _, ok := c.indexes[name]; !ok {
+			return status.Errorf(codes.NotFound, "index '%s' not exists", name)
+		}
+		t.put(indexIDPrefix+name, nil)
+		t.commit = append(t.commit, func() {
+			delete(c.indexes, name)
+		})
+		return nil
+	})
+}
+
+func (c *storageServer) ListIndexes(ctx context.Context, request *pbCRUD.ListIndexesRequest) (_ *pbCRUD.ListIndexesResponse, err error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	indexes := make([]*pbCRUD.Index, 0, len(c.indexes))
+	for _, idx := range c.indexes {
+		indexes = append(indexes, &pbCRUD.Index{Name: idx.name, Path: idx.path})
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+
+	return &pbCRUD.ListIndexesResponse{Indexes: indexes}, nil
+}
+
+func (c *storageServer) Query(ctx context.Context, request *pbCRUD.QueryRequest) (_ *pbCRUD.QueryResponse, err error) {
+	log.Info().Caller().Msg("query")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("query failed")
+		} else {
+			log.Info().Caller().Msg("query done")
+		}
+	}()
+
+	after, err := decodePageToken(request.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	items, next, err := c.query(ctx, request.GetPredicates(), after, pageSize(request.GetPageSize()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.QueryResponse{Items: items, NextPageToken: encodePageToken(next)}, nil
+}
+
+// query returns up to limit records matching all predicates which ids are greater than after
+func (c *storageServer) query(ctx context.Context, predicates []*pbCRUD.Predicate, after string, limit int) (items []*pbCRUD.Data, next string, err error) {
+	if len(predicates) == 0 {
+		return nil, "", status.Errorf(codes.InvalidArgument, "no predicates")
+	}
+
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	name := collectionFromContext(ctx)
+	if _, err := c.collection(name); err != nil {
+		return nil, "", err
+	}
+
+	// indexes cover records of all collections, matched keys are filtered by collection of request
+	var matched map[string]struct{}
+	for _, p := range predicates {
+		idx, ok := c.indexes[p.GetIndex()]
+		if !ok {
+			return nil, "", status.Errorf(codes.InvalidArgument, "index '%s' not exists", p.GetIndex())
+		}
+		v, err := indexValueOfProto(p.GetValue())
+		if err != nil {
+			return nil, "", err
+		}
+		ids := idx.match(p.GetOp(), v)
+		if matched == nil {
+			matched = ids
+			continue
+		}
+		for id := range matched {
+			if _, ok := ids[id]; !ok {
+				delete(matched, id)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(matched))
+	for key := range matched {
+		if collection, id := splitKey(key); collection == name && id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	items = make([]*pbCRUD.Data, 0, limit)
+	for i, id := range ids {
+		if len(items) == limit {
+			next = ids[i-1]
+			break
+		}
+		r, ok, err := c.data.Get(recordKey(name, id))
+		if err != nil {
+			return nil, "", status.Errorf(codes.Internal, err.Error())
+		}
+		if !ok || r.expired(now) || r.deleted() {
+			continue
+		}
+		items = append(items, &pbCRUD.Data{
+			Id:       id,
+			Raw:      r.Raw,
+			Version:  r.Version,
+			Metadata: r.metadata(),
+		})
+	}
+
+	return items, next, nil
+}
+
+// reindex applies committed mutations to indexes, tombstones are removed from indexes. Caller holds dataMtx
+func (c *storageServer) reindex(mutations []Mutation) {
+	for _, m := range mutations {
+		if isSystemID(m.ID) {
+			continue
+		}
+		r := m.Record
+		if r != nil && r.deleted() {
+			r = nil
+		}
+		for _, idx := range c.indexes {
+			idx.update(m.ID, r)
+		}
+	}
+}
+
+// loadIndexes builds indexes by stored definitions
+func (c *storageServer) loadIndexes() error {
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	ids, err := c.data.Keys()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, indexIDPrefix) {
+			continue
+		}
+		r, ok, err := c.data.Get(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var definition indexDefinition
+		if err := json.Unmarshal(r.Raw, &definition); err != nil {
+			return err
+		}
+		idx, err := c.buildIndex(definition.Name, definition.Path)
+		if err != nil {
+			return err
+		}
+		c.indexes[definition.Name] = idx
+		log.Info().Caller().Str("index", definition.Name).Str("path", definition.Path).Int("entries", len(idx.entries)).Msg("index loaded")
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// subjects of quota violations in errdetails.QuotaFailure
+const (
+	quotaMaxRecords    = "max-records"
+	quotaMaxBytes      = "max-bytes"
+	quotaMaxObjectSize = "max-object-size"
+)
+
+// Quota limits records owned by user. Zero limit means no limit
+type Quota struct {
+	MaxRecords    uint64 `json:"max_records"`
+	MaxBytes      uint64 `json:"max_bytes"`
+	MaxObjectSize uint64 `json:"max_object_size"`
+}
+
+// usage of user, signed for deltas
+type usage struct {
+	records int64
+	bytes   int64
+}
+
+// usageCounter is a usage of user or collection which concurrent writes change without lock
+type usageCounter struct {
+	records atomic.Int64
+	bytes   atomic.Int64
+}
+
+func (u *usageCounter) load() usage {
+	return usage{records: u.records.Load(), bytes: u.bytes.Load()}
+}
+
+// usageCounters are usages by owners. Counter of owner is created once and then changed atomically,
+// so writes lock map of counters for reading only
+type usageCounters struct {
+	mtx      sync.RWMutex
+	counters map[string]*usageCounter
+}
+
+func newUsageCounters() *usageCounters {
+	return &usageCounters{counters: make(map[string]*usageCounter)}
+}
+
+// counter returns counter of owner, missing counter is created
+func (u *usageCounters) counter(owner string) *usageCounter {
+	u.mtx.RLock()
+	counter, ok := u.counters[owner]
+	u.mtx.RUnlock()
+	if ok {
+		return counter
+	}
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if counter, ok := u.counters[owner]; ok {
+		return counter
+	}
+	counter = &usageCounter{}
+	u.counters[owner] = counter
+	return counter
+}
+
+func (u *usageCounters) get(owner string) usage {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+
+	if counter, ok := u.counters[owner]; ok {
+		return counter.load()
+	}
+	return usage{}
+}
+
+// total returns usage of all owners
+func (u *usageCounters) total() usage {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+
+	var total usage
+	for _, counter := range u.counters {
+		total = total.add(counter.records.Load(), counter.bytes.Load())
+	}
+	return total
+}
+
+// remove drops counter of owner. Caller holds dataMtx for writing, so no write changes the counter
+func (u *usageCounters) remove(owner string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	delete(u.counters, owner)
+}
+
+func (c *storageServer) quota(user string) Quota {
+	if q, ok := c.opts.Quotas[user]; ok {
+		return q
+	}
+	return c.opts.DefaultQuota
+}
+
+// quotaError makes error of quota violation, owner is a user or a collection which quota is exceeded
+func quotaError(owner, subject, description string) error {
+	s, err := status.New(codes.ResourceExhausted, fmt.Sprintf("quota of %s exceeded: %s", owner, description)).WithDetails(
+		&errdetails.QuotaFailure{
+			Violations: []*errdetails.QuotaFailure_Violation{{
+				Subject:     subject,
+				Description: description,
+			}},
+		},
+	)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	return s.Err()
+}
+
+// usageDeltas are changes of usage by record owners and by collections and changes of sizes of records
+type usageDeltas struct {
+	users       map[string]usage
+	collections map[string]usage
+	sizes       sizeHistogram
+	// history is a change of size of past versions, they are accounted in bytes of owners and collections
+	history int64
+}
+
+func newUsageDeltas() *usageDeltas {
+	return &usageDeltas{users: make(map[string]usage), collections: make(map[string]usage)}
+}
+
+// add accounts record by backend key multiplied by sign. Past versions are accounted in bytes of their owners
+// and collections, but they are not records. Other system records are not accounted
+func (d *usageDeltas) add(key string, r *Record, sign int64) {
+	bytes, records := sign*int64(r.Size), sign
+	if owner, ok := versionOwner(key); ok {
+		key, records = owner, 0
+		d.history += bytes
+	} else {
+		d.sizes.add(r.Size, sign)
+	}
+	collection, _ := splitKey(key)
+	d.users[r.CreatedBy] = d.users[r.CreatedBy].add(records, bytes)
+	d.collections[collection] = d.collections[collection].add(records, bytes)
+}
+
+// accounted is true for keys of records and past versions of records
+func accounted(key string) bool {
+	_, ok := versionOwner(key)
+	return ok || !isSystemID(key)
+}
+
+// usageDelta computes changes of usage by record owners and by collections. Caller holds dataMtx
+// and stripes of mutations, mutations are not applied yet
+func (c *storageServer) usageDelta(mutations []Mutation) (*usageDeltas, error) {
+	d := newUsageDeltas()
+	for _, m := range mutations {
+		if !accounted(m.ID) {
+			continue
+		}
+		old, ok, err := c.data.Get(m.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			d.add(m.ID, old, -1)
+		}
+		if m.Record != nil {
+			d.add(m.ID, m.Record, 1)
+		}
+	}
+	return d, nil
+}
+
+func (u usage) add(records, bytes int64) usage {
+	return usage{records: u.records + records, bytes: u.bytes + bytes}
+}
+
+// reserve checks quotas and accounts usage delta of write before it is applied, so concurrent writes
+// do not exceed quota together. Delta is added before usage is checked, so concurrent writes which exceed quota
+// only together may both fail. Reserved usage is released if write fails
+func (c *storageServer) reserve(mutations []Mutation, d *usageDeltas) error {
+	live, err := c.checkObjectSizes(mutations)
+	if err != nil {
+		return err
+	}
+	c.account(d, 1)
+	if !live {
+		return nil
+	}
+	if err := c.checkUsages(d.users, d.collections); err != nil {
+		c.account(d, -1)
+		return err
+	}
+	return nil
+}
+
+// account adds usage delta multiplied by sign to total usage, negative sign releases reserved usage
+func (c *storageServer) account(d *usageDeltas, sign int64) {
+	addUsage(c.usage, d.users, sign)
+	addUsage(c.collectionsUsage, d.collections, sign)
+	for i, n := range d.sizes {
+		if n != 0 {
+			c.sizes[i].Add(sign * n)
+		}
+	}
+	if d.history != 0 {
+		c.historyBytes.Add(sign * d.history)
+	}
+}
+
+// checkObjectSizes fails if some mutation writes record greater than max object size of its owner or collection.
+// live is false for writes without live records: shrinking usage and such writes never fail, so owner over quota
+// is still able to delete records even if past versions of deleted records grow usage. Caller holds dataMtx
+func (c *storageServer) checkObjectSizes(mutations []Mutation) (live bool, err error) {
+	for _, m := range mutations {
+		if m.Record == nil || isSystemID(m.ID) {
+			continue
+		}
+		live = live || !m.Record.deleted()
+		if user := m.Record.CreatedBy; user != "" {
+			if err := checkObjectSize(userOwner(user), c.quota(user), m.Record.Size); err != nil {
+				return false, err
+			}
+		}
+		if name, _ := splitKey(m.ID); name != "" {
+			if settings, ok := c.collections[name]; ok {
+				if err := checkObjectSize(collectionOwner(name), settings.Quota, m.Record.Size); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	return live, nil
+}
+
+// checkUsages fails if deltas grew usage of some owner or collection over quota. Deltas are accounted already.
+// Caller holds dataMtx
+func (c *storageServer) checkUsages(users, collections map[string]usage) error {
+	for user, d := range users {
+		if user == "" {
+			continue
+		}
+		if err := checkUsage(userOwner(user), c.quota(user), c.usage.get(user), d); err != nil {
+			return err
+		}
+	}
+	for name, d := range collections {
+		settings, ok := c.collections[name]
+		if !ok {
+			continue
+		}
+		if err := checkUsage(collectionOwner(name), settings.Quota, c.collectionsUsage.get(name), d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userOwner(user string) string {
+	return fmt.Sprintf("user '%s'", user)
+}
+
+func collectionOwner(name string) string {
+	return fmt.Sprintf("collection '%s'", name)
+}
+
+func checkObjectSize(owner string, q Quota, size uint64) error {
+	if q.MaxObjectSize > 0 && size > q.MaxObjectSize {
+		return quotaError(owner, quotaMaxObjectSize, fmt.Sprintf("object size %d is greater than %d", size, q.MaxObjectSize))
+	}
+	return nil
+}
+
+// checkUsage fails if delta grew usage u over quota q, u includes delta
+func checkUsage(owner string, q Quota, u, d usage) error {
+	if d.records > 0 && q.MaxRecords > 0 && u.records > int64(q.MaxRecords) {
+		return quotaError(owner, quotaMaxRecords,
+			fmt.Sprintf("records count %d is greater than %d", u.records, q.MaxRecords))
+	}
+	if d.bytes > 0 && q.MaxBytes > 0 && u.bytes > int64(q.MaxBytes) {
+		return quotaError(owner, quotaMaxBytes,
+			fmt.Sprintf("total size %d is greater than %d", u.bytes, q.MaxBytes))
+	}
+	return nil
+}
+
+// addUsage adds usage delta multiplied by sign to counters of owners
+func addUsage(counters *usageCounters, delta map[string]usage, sign int64) {
+	for owner, d := range delta {
+		if d.records == 0 && d.bytes == 0 {
+			continue
+		}
+		counter := counters.counter(owner)
+		counter.records.Add(sign * d.records)
+		counter.bytes.Add(sign * d.bytes)
+	}
+}
+
+func (c *storageServer) GetUsage(ctx context.Context, request *pbCRUD.GetUsageRequest) (_ *pbCRUD.GetUsageResponse, err error) {
+	log.Info().Caller().Msg("get usage")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("get usage failed")
+		} else {
+			log.Info().Caller().Msg("get usage done")
+		}
+	}()
+
+	user := userFromContext(ctx)
+	u, q := c.usage.get(user), c.quota(user)
+
+	return &pbCRUD.GetUsageResponse{
+		User:          user,
+		Records:       uint64(u.records),
+		Bytes:         uint64(u.bytes),
+		MaxRecords:    q.MaxRecords,
+		MaxBytes:      q.MaxBytes,
+		MaxObjectSize: q.MaxObjectSize,
+	}, nil
+}
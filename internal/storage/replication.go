@@ -0,0 +1,561 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
+)
+
+const (
+	// replicaQueueSize is a max count of writes queued for follower, slower follower is disconnected and bootstraps again
+	replicaQueueSize = 10000
+	// replicationBatchSize is a max count of records in one message of snapshot
+	replicationBatchSize = 100
+	// replicationBatchBytes is a size of encoded records after which message of snapshot is sent,
+	// message keeps at least one record
+	replicationBatchBytes = 1 << 20
+	// heartbeatInterval is a period of heartbeats which let follower know last write of leader
+	heartbeatInterval = time.Second
+	// followRetryInterval is a delay before follower reconnects to leader
+	followRetryInterval = time.Second
+)
+
+// MaxReplicationMessageSize is a max size of message of replication stream which leader sends and follower
+// receives. Single write and single record of snapshot are never split, so it is not limited by default 4 MB of gRPC
+const MaxReplicationMessageSize = math.MaxInt32
+
+// notLeaderReason is a reason of error info of writes rejected by follower, metadata "leader" keeps address of leader
+const notLeaderReason = "NOT_LEADER"
+
+// replica is a follower subscribed to writes of leader
+type replica struct {
+	address string
+	writes  chan *pbAdmin.ReplicateResponse
+	// closed when queue of follower overflows
+	dropped chan struct{}
+	// guarded by dataMtx
+	bootstrapping bool
+	// sequence number of last write sent to follower, atomic access
+	sent uint64
+}
+
+// following is a state of replication on follower
+type following struct {
+	// connected is true after snapshot is applied until stream from leader breaks
+	connected   bool
+	lastContact time.Time
+	// last write of leader known by follower and time of leader when it was known
+	leaderSequence uint64
+	leaderAt       time.Time
+	// time of leader when last applied write was committed
+	appliedAt time.Time
+}
+
+// portable is false for keys of system records which are local for node, such records are not replicated or exported
+func portable(key string) bool {
+	return !strings.HasPrefix(key, encryptionIDPrefix)
+}
+
+// notLeaderError rejects request on follower with address of leader in details. Caller holds dataMtx
+func (c *storageServer) notLeaderError() error {
+	s, err := status.Newf(codes.Unavailable, "node is a follower, write to leader '%s'", c.leader).WithDetails(
+		&errdetails.ErrorInfo{
+			Reason:   notLeaderReason,
+			Domain:   "storage",
+			Metadata: map[string]string{"leader": c.leader},
+		},
+	)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	return s.Err()
+}
+
+func replicatedMutations(mutations []Mutation) ([]*pbAdmin.ReplicatedMutation, error) {
+	replicatedMutations := make([]*pbAdmin.ReplicatedMutation, 0, len(mutations))
+	for _, m := range mutations {
+		if !portable(m.ID) {
+			continue
+		}
+		rm := &pbAdmin.ReplicatedMutation{Key: m.ID}
+		if m.Record != nil {
+			raw, err := json.Marshal(m.Record)
+			if err != nil {
+				return nil, err
+			}
+			rm.Record = raw
+		}
+		replicatedMutations = append(replicatedMutations, rm)
+	}
+	return replicatedMutations, nil
+}
+
+func mutationsOfReplicated(replicatedMutations []*pbAdmin.ReplicatedMutation) ([]Mutation, error) {
+	mutations := make([]Mutation, 0, len(replicatedMutations))
+	for _, rm := range replicatedMutations {
+		m := Mutation{ID: rm.GetKey()}
+		if len(rm.GetRecord()) > 0 {
+			m.Record = &Record{}
+			if err := json.Unmarshal(rm.GetRecord(), m.Record); err != nil {
+				return nil, err
+			}
+		}
+		mutations = append(mutations, m)
+	}
+	return mutations, nil
+}
+
+// replicate queues committed write for followers. Caller holds commitMtx or dataMtx for writing
+func (c *storageServer) replicate(mutations []Mutation, events []*pbCDC.ListenResponse) {
+	if len(c.replicas) == 0 {
+		return
+	}
+	write := &pbAdmin.ReplicateResponse{
+		Sequence:    c.sequence,
+		CommittedAt: timestamppb.Now(),
+	}
+	var err error
+	write.Mutations, err = replicatedMutations(mutations)
+	for _, e := range events {
+		if err != nil {
+			break
+		}
+		var raw []byte
+		raw, err = proto.Marshal(e)
+		write.Events = append(write.Events, raw)
+	}
+	for r := range c.replicas {
+		if err != nil {
+			// followers which miss write must bootstrap again
+			log.Error().Caller().Str("follower", r.address).Err(err).Msg("replicate write failed")
+			close(r.dropped)
+			delete(c.replicas, r)
+			continue
+		}
+		select {
+		case r.writes <- write:
+		default:
+			log.Warn().Caller().Str("follower", r.address).Msg("follower is too slow")
+			close(r.dropped)
+			delete(c.replicas, r)
+		}
+	}
+}
+
+// Replicate sends snapshot of all records and then writes to follower until follower disconnects
+func (c *storageServer) Replicate(request *pbAdmin.ReplicateRequest, stream pbAdmin.Admin_ReplicateServer) (err error) {
+	r := &replica{
+		writes:        make(chan *pbAdmin.ReplicateResponse, replicaQueueSize),
+		dropped:       make(chan struct{}),
+		bootstrapping: true,
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		r.address = p.Addr.String()
+	}
+	log.Info().Caller().Str("follower", r.address).Msg("replicate")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Str("follower", r.address).Err(err).Msg("replicate failed")
+		} else {
+			log.Info().Caller().Str("follower", r.address).Msg("replicate done")
+		}
+	}()
+
+	c.dataMtx.Lock()
+	if c.leader != "" {
+		err := c.notLeaderError()
+		c.dataMtx.Unlock()
+		return err
+	}
+	keys, err := c.data.Keys()
+	if err != nil {
+		c.dataMtx.Unlock()
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	// records changed after this point are sent twice: in snapshot and in writes, follower ends up with the last state
+	sequence := c.sequence
+	c.replicas[r] = struct{}{}
+	c.dataMtx.Unlock()
+
+	defer func() {
+		c.dataMtx.Lock()
+		delete(c.replicas, r)
+		c.dataMtx.Unlock()
+	}()
+
+	if err := c.sendSnapshot(stream, keys, sequence); err != nil {
+		return err
+	}
+	c.dataMtx.Lock()
+	r.bootstrapping = false
+	c.dataMtx.Unlock()
+	atomic.StoreUint64(&r.sent, sequence)
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-c.shutdown:
+			return status.Errorf(codes.Unavailable, "storage is shutting down")
+		case <-r.dropped:
+			return status.Errorf(codes.ResourceExhausted, "follower is behind by more than %d writes", replicaQueueSize)
+		case write := <-r.writes:
+			if err := stream.Send(write); err != nil {
+				return err
+			}
+			atomic.StoreUint64(&r.sent, write.GetSequence())
+		case <-ticker.C:
+			c.commitMtx.Lock()
+			sequence := c.sequence
+			c.commitMtx.Unlock()
+			if err := stream.Send(&pbAdmin.ReplicateResponse{Sequence: sequence, CommittedAt: timestamppb.Now()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot sends stored records by batches, each batch is read under its own lock of dataMtx
+func (c *storageServer) sendSnapshot(stream pbAdmin.Admin_ReplicateServer, keys []string, sequence uint64) error {
+	for len(keys) > 0 {
+		batch, n, err := c.snapshotBatch(keys)
+		if err != nil {
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		keys = keys[n:]
+		if err := stream.Send(&pbAdmin.ReplicateResponse{Mutations: batch, Snapshot: true}); err != nil {
+			return err
+		}
+	}
+	return stream.Send(&pbAdmin.ReplicateResponse{
+		Sequence:     sequence,
+		CommittedAt:  timestamppb.Now(),
+		Snapshot:     true,
+		SnapshotDone: true,
+	})
+}
+
+// snapshotBatch reads records of first keys up to replicationBatchSize records and replicationBatchBytes bytes.
+// n is a count of read keys
+func (c *storageServer) snapshotBatch(keys []string) (batch []*pbAdmin.ReplicatedMutation, n int, err error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	size := 0
+	for n < len(keys) && n < replicationBatchSize && size < replicationBatchBytes {
+		key := keys[n]
+		n++
+		r, ok, err := c.data.Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			continue
+		}
+		replicated, err := replicatedMutations([]Mutation{{ID: key, Record: r}})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rm := range replicated {
+			size += len(rm.GetKey()) + len(rm.GetRecord())
+			batch = append(batch, rm)
+		}
+	}
+	return batch, n, nil
+}
+
+// follow replicates writes of leader until follower is promoted or closed
+func (c *storageServer) follow(ctx context.Context, leader string) {
+	cc, err := grpc.DialContext(ctx, leader,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(MaxReplicationMessageSize)),
+	)
+	if err != nil {
+		log.Error().Caller().Str("leader", leader).Err(err).Msg("dial to leader failed")
+		return
+	}
+	defer cc.Close()
+	client := pbAdmin.NewAdminClient(cc)
+
+	for {
+		log.Info().Caller().Str("leader", leader).Msg("follow")
+		err := c.receive(ctx, client)
+
+		c.dataMtx.Lock()
+		c.following.connected = false
+		c.dataMtx.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Caller().Str("leader", leader).Err(err).Msg("follow failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(followRetryInterval):
+		}
+	}
+}
+
+// receive applies snapshot and then writes of leader
+func (c *storageServer) receive(ctx context.Context, client pbAdmin.AdminClient) error {
+	stream, err := client.Replicate(ctx, &pbAdmin.ReplicateRequest{})
+	if err != nil {
+		return err
+	}
+
+	// keys of snapshot, stored records which are not in snapshot are removed when snapshot is done
+	snapshot := make(map[string]struct{})
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		mutations, err := mutationsOfReplicated(msg.GetMutations())
+		if err != nil {
+			return err
+		}
+		events := make([]*pbCDC.ListenResponse, 0, len(msg.GetEvents()))
+		for _, raw := range msg.GetEvents() {
+			e := &pbCDC.ListenResponse{}
+			if err := proto.Unmarshal(raw, e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+
+		err = func() error {
+			c.dataMtx.Lock()
+			defer c.dataMtx.Unlock()
+
+			if c.leader == "" {
+				return status.Errorf(codes.Canceled, "follower is promoted")
+			}
+			c.following.lastContact = time.Now()
+			if msg.GetSequence() >= c.following.leaderSequence {
+				c.following.leaderSequence = msg.GetSequence()
+				c.following.leaderAt = msg.GetCommittedAt().AsTime()
+			}
+
+			if msg.GetSnapshot() {
+				for _, m := range mutations {
+					snapshot[m.ID] = struct{}{}
+				}
+				if err := c.applyRecords(mutations); err != nil {
+					return err
+				}
+				if !msg.GetSnapshotDone() {
+					return nil
+				}
+				if err := c.removeStale(snapshot); err != nil {
+					return err
+				}
+				snapshot = nil
+				c.following.connected = true
+				log.Info().Caller().Uint64("sequence", msg.GetSequence()).Msg("snapshot applied")
+			} else if len(mutations) == 0 {
+				// heartbeat
+				return nil
+			} else if err := c.applyRecords(mutations); err != nil {
+				return err
+			}
+			c.commitMtx.Lock()
+			c.sequence = msg.GetSequence()
+			c.commitMtx.Unlock()
+			c.following.appliedAt = msg.GetCommittedAt().AsTime()
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+		c.publish(events)
+	}
+}
+
+// removeStale removes stored records which are not in snapshot of leader. Caller holds dataMtx
+func (c *storageServer) removeStale(snapshot map[string]struct{}) error {
+	keys, err := c.data.Keys()
+	if err != nil {
+		return err
+	}
+	var stale []Mutation
+	for _, key := range keys {
+		if _, ok := snapshot[key]; !ok && portable(key) {
+			stale = append(stale, Mutation{ID: key})
+		}
+	}
+	return c.applyRecords(stale)
+}
+
+// applyRecords applies mutations of leader or of imported archive and updates collections and indexes
+// by their system records. Caller holds dataMtx for writing
+func (c *storageServer) applyRecords(mutations []Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	d, err := c.usageDelta(mutations)
+	if err != nil {
+		return err
+	}
+	if err := c.apply(mutations); err != nil {
+		return err
+	}
+	c.account(d, 1)
+	for _, m := range mutations {
+		switch {
+		case strings.HasPrefix(m.ID, collectionIDPrefix):
+			name := strings.TrimPrefix(m.ID, collectionIDPrefix)
+			if m.Record == nil {
+				delete(c.collections, name)
+				// removed settings of default collection remove its schema only
+				if name != "" {
+					c.collectionsUsage.remove(name)
+				}
+				continue
+			}
+			var settings collection
+			if err := json.Unmarshal(m.Record.Raw, &settings); err != nil {
+				return err
+			}
+			if err := settings.compile(); err != nil {
+				log.Error().Caller().Err(err).Str("collection", settings.Name).Msg("schema is not enforced")
+			}
+			c.collections[settings.Name] = &settings
+		case strings.HasPrefix(m.ID, indexIDPrefix):
+			name := strings.TrimPrefix(m.ID, indexIDPrefix)
+			if m.Record == nil {
+				delete(c.indexes, name)
+				continue
+			}
+			var definition indexDefinition
+			if err := json.Unmarshal(m.Record.Raw, &definition); err != nil {
+				return err
+			}
+			idx, err := c.buildIndex(definition.Name, definition.Path)
+			if err != nil {
+				return err
+			}
+			c.indexes[definition.Name] = idx
+		}
+	}
+	return nil
+}
+
+// watchLeader promotes follower when leader is silent longer than PromoteAfter
+func (c *storageServer) watchLeader(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.dataMtx.RLock()
+			silence := now.Sub(c.following.lastContact)
+			c.dataMtx.RUnlock()
+			if silence < c.opts.PromoteAfter {
+				continue
+			}
+			log.Warn().Caller().Stringer("silence", silence).Msg("leader is unreachable")
+			if err := c.promote(); err != nil {
+				log.Error().Caller().Err(err).Msg("promote failed")
+			}
+			return
+		}
+	}
+}
+
+// promote stops replication and makes follower a leader
+func (c *storageServer) promote() error {
+	c.dataMtx.Lock()
+	if c.leader == "" {
+		c.dataMtx.Unlock()
+		return status.Errorf(codes.FailedPrecondition, "node is a leader already")
+	}
+	log.Warn().Caller().Str("leader", c.leader).Uint64("sequence", c.sequence).Msg("promoted to leader")
+	c.leader = ""
+	c.following = following{}
+	stop := c.stopFollowing
+	c.stopFollowing = nil
+	c.dataMtx.Unlock()
+
+	stop()
+	// expirations are replicated from leader while node follows it
+	select {
+	case c.expirationsWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *storageServer) Promote(ctx context.Context, request *pbAdmin.PromoteRequest) (_ *pbAdmin.PromoteResponse, err error) {
+	log.Info().Caller().Msg("promote")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("promote failed")
+		} else {
+			log.Info().Caller().Msg("promote done")
+		}
+	}()
+
+	if err := c.promote(); err != nil {
+		return nil, err
+	}
+
+	return &pbAdmin.PromoteResponse{}, nil
+}
+
+func (c *storageServer) ReplicationStatus(ctx context.Context, request *pbAdmin.ReplicationStatusRequest) (_ *pbAdmin.ReplicationStatusResponse, err error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+	c.commitMtx.Lock()
+	defer c.commitMtx.Unlock()
+
+	response := &pbAdmin.ReplicationStatusResponse{
+		Leader:   c.leader,
+		Sequence: c.sequence,
+	}
+	if c.leader != "" {
+		response.LeaderSequence = c.following.leaderSequence
+		response.Connected = c.following.connected
+		if !c.following.lastContact.IsZero() {
+			response.LastContact = timestamppb.New(c.following.lastContact)
+		}
+		lag := time.Duration(0)
+		if c.following.leaderSequence > c.sequence && c.following.leaderAt.After(c.following.appliedAt) {
+			lag = c.following.leaderAt.Sub(c.following.appliedAt)
+		}
+		response.Lag = durationpb.New(lag)
+	}
+	for r := range c.replicas {
+		response.Followers = append(response.Followers, &pbAdmin.Follower{
+			Address:       r.address,
+			Sequence:      atomic.LoadUint64(&r.sent),
+			Pending:       uint64(len(r.writes)),
+			Bootstrapping: r.bootstrapping,
+		})
+	}
+	sort.Slice(response.Followers, func(i, j int) bool { return response.Followers[i].Address < response.Followers[j].Address })
+
+	return response, nil
+}
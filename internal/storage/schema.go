@@ -0,0 +1,519 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxSchemaViolations is a max count of violations reported for one record
+const maxSchemaViolations = 20
+
+// unsupportedKeywords change validation result, so schema with them is rejected instead of being checked partially
+var unsupportedKeywords = []string{
+	"$ref", "$dynamicRef", "$recursiveRef", "if", "then", "else", "patternProperties", "propertyNames",
+	"dependentRequired", "dependentSchemas", "dependencies", "prefixItems", "contains",
+	"unevaluatedProperties", "unevaluatedItems",
+}
+
+// schema is a compiled JSON Schema. Subset of draft 2020-12 is supported: boolean schemas, type, enum, const,
+// properties, required, additionalProperties, minProperties, maxProperties, items, minItems, maxItems,
+// uniqueItems, minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+// allOf, anyOf, oneOf and not. Annotations like title, description and format are ignored
+type schema struct {
+	// reject is true for false schema
+	reject bool
+
+	types  []string
+	enum   []interface{}
+	consts []interface{}
+
+	properties           map[string]*schema
+	required             []string
+	additionalProperties *schema
+	minProperties        *int
+	maxProperties        *int
+
+	items       *schema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*schema
+	anyOf []*schema
+	oneOf []*schema
+	not   *schema
+}
+
+// compileSchema parses JSON Schema document
+func compileSchema(raw []byte) (*schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return compileNode(doc, "")
+}
+
+func compileNode(node interface{}, path string) (*schema, error) {
+	switch node := node.(type) {
+	case bool:
+		return &schema{reject: !node}, nil
+	case map[string]interface{}:
+		return compileObject(node, path)
+	default:
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", pointer(path))
+	}
+}
+
+func compileObject(node map[string]interface{}, path string) (*schema, error) {
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := node[keyword]; ok {
+			return nil, fmt.Errorf("%s: keyword '%s' is not supported", pointer(path), keyword)
+		}
+	}
+
+	s := &schema{}
+	var err error
+	// keyword errors are reported by the first failed keyword
+	fail := func(keyword, format string, args ...interface{}) error {
+		return fmt.Errorf("%s: %s", pointer(path+"/"+keyword), fmt.Sprintf(format, args...))
+	}
+
+	if v, ok := node["type"]; ok {
+		switch v := v.(type) {
+		case string:
+			s.types = []string{v}
+		case []interface{}:
+			for _, t := range v {
+				t, ok := t.(string)
+				if !ok {
+					return nil, fail("type", "type must be a string")
+				}
+				s.types = append(s.types, t)
+			}
+		default:
+			return nil, fail("type", "type must be a string or an array of strings")
+		}
+		for _, t := range s.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fail("type", "unknown type '%s'", t)
+			}
+		}
+	}
+	if v, ok := node["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return nil, fail("enum", "enum must be an array")
+		}
+	}
+	if v, ok := node["const"]; ok {
+		s.consts = []interface{}{v}
+	}
+
+	if v, ok := node["properties"]; ok {
+		properties, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fail("properties", "properties must be an object")
+		}
+		s.properties = make(map[string]*schema, len(properties))
+		for name, p := range properties {
+			if s.properties[name], err = compileNode(p, path+"/properties/"+escapePointer(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := node["required"]; ok {
+		required, ok := v.([]interface{})
+		if !ok {
+			return nil, fail("required", "required must be an array of strings")
+		}
+		for _, name := range required {
+			name, ok := name.(string)
+			if !ok {
+				return nil, fail("required", "required must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if v, ok := node["additionalProperties"]; ok {
+		if s.additionalProperties, err = compileNode(v, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := node["items"]; ok {
+		if s.items, err = compileNode(v, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := node["uniqueItems"]; ok {
+		if s.uniqueItems, ok = v.(bool); !ok {
+			return nil, fail("uniqueItems", "uniqueItems must be a boolean")
+		}
+	}
+	if v, ok := node["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return nil, fail("pattern", "pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fail("pattern", "%s", err.Error())
+		}
+	}
+
+	counts := map[string]**int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	}
+	for keyword, field := range counts {
+		v, ok := node[keyword]
+		if !ok {
+			continue
+		}
+		n, ok := v.(float64)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			return nil, fail(keyword, "%s must be a non-negative integer", keyword)
+		}
+		count := int(n)
+		*field = &count
+	}
+
+	limits := map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	}
+	for keyword, field := range limits {
+		v, ok := node[keyword]
+		if !ok {
+			continue
+		}
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fail(keyword, "%s must be a number", keyword)
+		}
+		*field = &n
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fail("multipleOf", "multipleOf must be greater than 0")
+	}
+
+	subschemas := map[string]*[]*schema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	}
+	for keyword, field := range subschemas {
+		v, ok := node[keyword]
+		if !ok {
+			continue
+		}
+		nodes, ok := v.([]interface{})
+		if !ok || len(nodes) == 0 {
+			return nil, fail(keyword, "%s must be a non-empty array", keyword)
+		}
+		for i, n := range nodes {
+			sub, err := compileNode(n, path+"/"+keyword+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			*field = append(*field, sub)
+		}
+	}
+	if v, ok := node["not"]; ok {
+		if s.not, err = compileNode(v, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// schemaViolation is a violation of schema by value at JSON pointer
+type schemaViolation struct {
+	path        string
+	description string
+}
+
+// validate returns violations of schema by JSON document, not JSON document violates any schema
+func (s *schema) validate(raw []byte) []schemaViolation {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return []schemaViolation{{description: fmt.Sprintf("value is not valid JSON: %s", err.Error())}}
+	}
+	if d.More() {
+		return []schemaViolation{{description: "value is not valid JSON: data after top-level value"}}
+	}
+	var violations []schemaViolation
+	s.check(doc, "", &violations)
+	if len(violations) > maxSchemaViolations {
+		violations = violations[:maxSchemaViolations]
+	}
+	return violations
+}
+
+// matches is true if value satisfies schema
+func (s *schema) matches(v interface{}, path string) bool {
+	var violations []schemaViolation
+	s.check(v, path, &violations)
+	return len(violations) == 0
+}
+
+func (s *schema) check(v interface{}, path string, violations *[]schemaViolation) {
+	violate := func(format string, args ...interface{}) {
+		*violations = append(*violations, schemaViolation{path: path, description: fmt.Sprintf(format, args...)})
+	}
+
+	if s.reject {
+		violate("value is not allowed")
+		return
+	}
+	if len(s.types) > 0 && !s.hasType(v) {
+		violate("value is %s, expected %s", typeOf(v), strings.Join(s.types, " or "))
+		// other keywords would report mismatched type again
+		return
+	}
+	if s.enum != nil && !contains(s.enum, v) {
+		violate("value is not one of enum values")
+	}
+	if s.consts != nil && !contains(s.consts, v) {
+		violate("value is not equal to const value")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		s.checkObject(v, path, violations, violate)
+	case []interface{}:
+		s.checkArray(v, path, violations, violate)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			violate("string is shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			violate("string is longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			violate("string does not match pattern '%s'", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			violate("number is less than %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			violate("number is greater than %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			violate("number is not greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			violate("number is not less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := v / *s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				violate("number is not a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.check(v, path, violations)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.matches(v, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violate("value does not match any schema of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.matches(v, path) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			violate("value matches %d schemas of oneOf, expected exactly one", matched)
+		}
+	}
+	if s.not != nil && s.not.matches(v, path) {
+		violate("value matches schema of not")
+	}
+}
+
+func (s *schema) checkObject(v map[string]interface{}, path string, violations *[]schemaViolation, violate func(string, ...interface{})) {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			*violations = append(*violations, schemaViolation{
+				path:        path + "/" + escapePointer(name),
+				description: "required property is missing",
+			})
+		}
+	}
+	if s.minProperties != nil && len(v) < *s.minProperties {
+		violate("object has less than %d properties", *s.minProperties)
+	}
+	if s.maxProperties != nil && len(v) > *s.maxProperties {
+		violate("object has more than %d properties", *s.maxProperties)
+	}
+	// properties are checked in order of names, so violations are reported in stable order
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, ok := s.properties[name]
+		if !ok {
+			p = s.additionalProperties
+		}
+		if p != nil {
+			if ok || !p.reject {
+				p.check(v[name], path+"/"+escapePointer(name), violations)
+			} else {
+				*violations = append(*violations, schemaViolation{
+					path:        path + "/" + escapePointer(name),
+					description: "additional property is not allowed",
+				})
+			}
+		}
+	}
+}
+
+func (s *schema) checkArray(v []interface{}, path string, violations *[]schemaViolation, violate func(string, ...interface{})) {
+	if s.minItems != nil && len(v) < *s.minItems {
+		violate("array has less than %d items", *s.minItems)
+	}
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		violate("array has more than %d items", *s.maxItems)
+	}
+	if s.uniqueItems {
+	unique:
+		for i := range v {
+			for j := 0; j < i; j++ {
+				if equalJSON(v[i], v[j]) {
+					violate("array items %d and %d are equal", j, i)
+					break unique
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range v {
+			s.items.check(item, path+"/"+strconv.Itoa(i), violations)
+		}
+	}
+}
+
+func (s *schema) hasType(v interface{}) bool {
+	actual := typeOf(v)
+	for _, t := range s.types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns JSON Schema type of decoded JSON value, number without fraction is an integer
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if equalJSON(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalJSON compares decoded JSON values, decoded numbers are float64 always
+func equalJSON(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// escapePointer escapes reference token of JSON pointer
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// pointer returns JSON pointer of path, root is shown as "/"
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// schemaError makes error of schema violations with violations as field violations of bad request
+func schemaError(name string, violations []schemaViolation) error {
+	return violationsError(codes.InvalidArgument, fmt.Sprintf("record violates schema of collection '%s'", name), violations)
+}
+
+// violationsError makes error with code and violations as field violations of bad request
+func violationsError(code codes.Code, message string, violations []schemaViolation) error {
+	br := &errdetails.BadRequest{}
+	for _, v := range violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       pointer(v.path),
+			Description: v.description,
+		})
+	}
+	s, err := status.Newf(code, "%s: %s: %s", message, pointer(violations[0].path), violations[0].description).WithDetails(br)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	return s.Err()
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	const person = `{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+			"a/b": {"const": 1}
+		},
+		"additionalProperties": false
+	}`
+
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		// JSON pointers of violations in reported order, empty if value is valid
+		paths []string
+	}{
+		{name: "valid object", schema: person, value: `{"name":"Ann","age":30,"tags":["a","b"]}`},
+		{name: "missing required property", schema: person, value: `{"age":30}`, paths: []string{"/name"}},
+		{name: "wrong type of root", schema: person, value: `[]`, paths: []string{"/"}},
+		{name: "integer with fraction", schema: person, value: `{"name":"Ann","age":1.5}`, paths: []string{"/age"}},
+		{name: "exclusive maximum", schema: person, value: `{"name":"Ann","age":150}`, paths: []string{"/age"}},
+		{name: "pattern and min length", schema: person, value: `{"name":""}`, paths: []string{"/name", "/name"}},
+		{name: "additional property", schema: person, value: `{"name":"Ann","extra":true}`, paths: []string{"/extra"}},
+		{name: "escaped property name", schema: person, value: `{"name":"Ann","a/b":2}`, paths: []string{"/a~1b"}},
+		{name: "array items", schema: person, value: `{"name":"Ann","tags":["a",1,"a","b"]}`,
+			paths: []string{"/tags", "/tags", "/tags/1"}},
+		{name: "violations in order of properties", schema: person, value: `{"tags":[1],"age":-1}`,
+			paths: []string{"/name", "/age", "/tags/0"}},
+		{name: "false schema", schema: `false`, value: `{}`, paths: []string{"/"}},
+		{name: "true schema", schema: `true`, value: `[1,"a",null]`},
+		{name: "enum", schema: `{"enum":["a",1,null]}`, value: `"b"`, paths: []string{"/"}},
+		{name: "enum compares numbers by value", schema: `{"enum":[1]}`, value: `1.0`},
+		{name: "multiple of", schema: `{"multipleOf":0.1}`, value: `0.3`},
+		{name: "any of", schema: `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, value: `true`, paths: []string{"/"}},
+		{name: "one of matched twice", schema: `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, value: `1`,
+			paths: []string{"/"}},
+		{name: "not", schema: `{"not":{"type":"null"}}`, value: `null`, paths: []string{"/"}},
+		{name: "all of reports nested paths", schema: `{"allOf":[{"required":["a"]},{"properties":{"b":{"type":"string"}}}]}`,
+			value: `{"b":1}`, paths: []string{"/a", "/b"}},
+		{name: "invalid JSON", schema: `true`, value: `{"a":`, paths: []string{"/"}},
+		{name: "data after value", schema: `true`, value: `{} {}`, paths: []string{"/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := compileSchema([]byte(test.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, v := range s.validate([]byte(test.value)) {
+				paths = append(paths, pointer(v.path))
+			}
+			if !reflect.DeepEqual(paths, test.paths) {
+				t.Fatalf("violations at %v, want %v", paths, test.paths)
+			}
+		})
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "not an object", schema: `1`},
+		{name: "unknown type", schema: `{"type":"text"}`},
+		{name: "unsupported keyword", schema: `{"properties":{"a":{"$ref":"#"}}}`},
+		{name: "wrong enum", schema: `{"enum":1}`},
+		{name: "wrong pattern", schema: `{"pattern":"("}`},
+		{name: "not JSON", schema: `{`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := compileSchema([]byte(test.schema)); err == nil {
+				t.Fatal("schema is compiled")
+			}
+		})
+	}
+}
+
+func TestSetSchema(t *testing.T) {
+	s, err := New(NewMemoryBackend(), Options{TombstoneRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	var schema structpb.Struct
+	if err := protojson.Unmarshal([]byte(`{"type":"object","required":["name"]}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	create := func(id, raw string) error {
+		_, err := s.Create(ctx, &pbCRUD.CreateRequest{Id: id, Raw: []byte(raw)})
+		return err
+	}
+
+	// steps run in order over same storage
+	steps := []struct {
+		name string
+		do   func() error
+		code codes.Code
+	}{
+		{name: "create valid record", do: func() error { return create("valid", `{"name":"a"}`) }},
+		{name: "create invalid record without schema", do: func() error { return create("invalid", `{}`) }},
+		{name: "set schema violated by stored record", code: codes.FailedPrecondition, do: func() error {
+			_, err := s.SetSchema(ctx, &pbCRUD.SetSchemaRequest{Schema: &schema})
+			return err
+		}},
+		{name: "schema is not changed by rejected request", do: func() error { return create("invalid-2", `[]`) }},
+		{name: "delete invalid records", do: func() error {
+			for _, id := range []string{"invalid", "invalid-2"} {
+				if _, err := s.Delete(ctx, &pbCRUD.DeleteRequest{Id: id}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{name: "set schema violated by tombstones only", do: func() error {
+			_, err := s.SetSchema(ctx, &pbCRUD.SetSchemaRequest{Schema: &schema})
+			return err
+		}},
+		{name: "create invalid record", code: codes.InvalidArgument, do: func() error { return create("invalid-3", `{}`) }},
+		{name: "set schema of missing collection", code: codes.NotFound, do: func() error {
+			_, err := s.SetSchema(ctx, &pbCRUD.SetSchemaRequest{Collection: "missing", Schema: &schema})
+			return err
+		}},
+		{name: "remove schema", do: func() error {
+			_, err := s.SetSchema(ctx, &pbCRUD.SetSchemaRequest{})
+			return err
+		}},
+		{name: "create invalid record after schema is removed", do: func() error { return create("invalid-3", `{}`) }},
+	}
+	for _, step := range steps {
+		if err := step.do(); status.Code(err) != step.code {
+			t.Fatalf("%s: %v, want %v", step.name, err, step.code)
+		}
+	}
+}
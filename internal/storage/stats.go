@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+// sizeBounds are upper bounds of buckets of sizes of values, larger values fall into extra last bucket
+var sizeBounds = [...]uint64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// sizeHistogram counts records by buckets of sizes of their values, signed for deltas
+type sizeHistogram [len(sizeBounds) + 1]int64
+
+func (h *sizeHistogram) add(size uint64, records int64) {
+	i := sort.Search(len(sizeBounds), func(i int) bool { return size <= sizeBounds[i] })
+	h[i] += records
+}
+
+// sizeCounters is a sizeHistogram of stored records which concurrent writes change without lock
+type sizeCounters [len(sizeBounds) + 1]atomic.Int64
+
+// operationStats counts calls of RPC method
+type operationStats struct {
+	calls  uint64
+	errors uint64
+	// total and max duration of calls
+	total time.Duration
+	max   time.Duration
+}
+
+// observe accounts call of RPC method
+func (c *storageServer) observe(method string, duration time.Duration, err error) {
+	c.operationsMtx.Lock()
+	defer c.operationsMtx.Unlock()
+
+	op, ok := c.operations[method]
+	if !ok {
+		op = &operationStats{}
+		c.operations[method] = op
+	}
+	op.calls++
+	if err != nil {
+		op.errors++
+	}
+	op.total += duration
+	if duration > op.max {
+		op.max = duration
+	}
+}
+
+// UnaryInterceptor accounts calls and latencies of unary RPC methods in Stats
+func (c *storageServer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	now := time.Now()
+	res, err := handler(ctx, req)
+	c.observe(strings.TrimPrefix(info.FullMethod, "/"), time.Since(now), err)
+	return res, err
+}
+
+// StreamInterceptor accounts calls and durations of streaming RPC methods in Stats
+func (c *storageServer) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	now := time.Now()
+	err := handler(srv, stream)
+	c.observe(strings.TrimPrefix(info.FullMethod, "/"), time.Since(now), err)
+	return err
+}
+
+func (c *storageServer) Stats(ctx context.Context, request *pbAdmin.StatsRequest) (_ *pbAdmin.StatsResponse, err error) {
+	log.Info().Caller().Msg("stats")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("stats failed")
+		} else {
+			log.Info().Caller().Msg("stats done")
+		}
+	}()
+
+	return c.stats(), nil
+}
+
+func (c *storageServer) stats() *pbAdmin.StatsResponse {
+	response := &pbAdmin.StatsResponse{}
+
+	total := c.collectionsUsage.total()
+	response.Records = uint64(total.records)
+	// bytes of records only, past versions are not records
+	response.Bytes = uint64(total.bytes - c.historyBytes.Load())
+	var sizes sizeHistogram
+	for i := range c.sizes {
+		sizes[i] = c.sizes[i].Load()
+	}
+
+	if response.Records > 0 {
+		response.AverageSize = float64(response.Bytes) / float64(response.Records)
+	}
+	for i, records := range sizes {
+		bucket := &pbAdmin.SizeBucket{Records: uint64(records)}
+		if i < len(sizeBounds) {
+			bucket.UpperBound = sizeBounds[i]
+		}
+		response.Sizes = append(response.Sizes, bucket)
+	}
+
+	c.operationsMtx.Lock()
+	for method, op := range c.operations {
+		response.Operations = append(response.Operations, &pbAdmin.OperationStats{
+			Operation:      method,
+			Calls:          op.calls,
+			Errors:         op.errors,
+			AverageLatency: durationpb.New(op.total / time.Duration(op.calls)),
+			MaxLatency:     durationpb.New(op.max),
+		})
+	}
+	c.operationsMtx.Unlock()
+	sort.Slice(response.Operations, func(i, j int) bool {
+		return response.Operations[i].Operation < response.Operations[j].Operation
+	})
+
+	c.listenersMtx.RLock()
+	response.Listeners = uint64(len(c.listeners))
+	c.listenersMtx.RUnlock()
+
+	c.eventsMtx.Lock()
+	response.QueueDepth = uint64(len(c.events) + c.sending)
+	c.eventsMtx.Unlock()
+
+	return response
+}
+
+// logStats logs stats every StatsInterval
+func (c *storageServer) logStats() {
+	ticker := time.NewTicker(c.opts.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		stats := c.stats()
+		sizes := zerolog.Dict()
+		for _, bucket := range stats.GetSizes() {
+			bound := "inf"
+			if bucket.GetUpperBound() > 0 {
+				bound = strconv.FormatUint(bucket.GetUpperBound(), 10)
+			}
+			sizes.Uint64(bound, bucket.GetRecords())
+		}
+		operations := zerolog.Dict()
+		for _, op := range stats.GetOperations() {
+			operations.Dict(op.GetOperation(), zerolog.Dict().
+				Uint64("calls", op.GetCalls()).
+				Uint64("errors", op.GetErrors()).
+				Stringer("average_latency", op.GetAverageLatency().AsDuration()).
+				Stringer("max_latency", op.GetMaxLatency().AsDuration()))
+		}
+		log.Info().Caller().
+			Uint64("records", stats.GetRecords()).
+			Uint64("bytes", stats.GetBytes()).
+			Float64("average_size", stats.GetAverageSize()).
+			Dict("sizes", sizes).
+			Dict("operations", operations).
+			Uint64("listeners", stats.GetListeners()).
+			Uint64("queue_depth", stats.GetQueueDepth()).
+			Msg("stats")
+	}
+}
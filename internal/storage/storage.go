@@ -2,12 +2,16 @@ package storage
 
 import (
 	"context"
-	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
 	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
 	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
 )
@@ -15,25 +19,136 @@ import (
 type storageServer struct {
 	pbCRUD.UnimplementedCRUDServer
 	pbCDC.UnimplementedCDCServer
+	pbAdmin.UnimplementedAdminServer
+
+	// writes of records hold dataMtx for reading and lock stripes of their keys,
+	// changes of collections, indexes, keys and replication state hold it for writing
+	dataMtx    sync.RWMutex
+	stripes    stripes
+	data       Backend
+	deduper    *dedupingBackend
+	compressor *compressingBackend
+	// nil if encryption is disabled
+	encryptor *encryptingBackend
+	// nil if memory budget is disabled
+	tier *tieredBackend
+	// guarded by dataMtx
+	rotating  bool
+	rotations chan struct{}
 
 	// read-write access
-	dataMtx sync.RWMutex
-	data    map[string][]byte
+	listenersMtx sync.RWMutex
+	listeners    map[pbCDC.CDC_ListenServer]*cdcListener
+
+	// CDC events of committed writes queued for listeners
+	eventsMtx  sync.Mutex
+	events     []*pbCDC.ListenResponse
+	eventsWake chan struct{}
+	// sending is a count of taken events which are not sent yet, guarded by eventsMtx
+	sending int
+
+	// calls of RPC methods by full name
+	operationsMtx sync.Mutex
+	operations    map[string]*operationStats
 
 	// read-write access
-	listenersMtx sync.RWMutex
-	listeners    map[pbCDC.CDC_ListenServer]chan struct{}
+	expirationsMtx  sync.Mutex
+	expirations     expirations
+	expirationsWake chan struct{}
+
+	// guarded by dataMtx, entries of indexes are guarded by their own mutexes too
+	indexes     map[string]*index
+	collections map[string]*collection
+	// keys of records in order, guarded by own mutex
+	keys *recordKeys
+
+	// changed by concurrent writes without lock
+	usage            *usageCounters
+	collectionsUsage *usageCounters
+	sizes            sizeCounters
+	// historyBytes is a size of past versions which is included in usage
+	historyBytes atomic.Int64
+
+	// guarded by dataMtx
+	// leader is an address of leader which is followed by node, empty if node is a leader
+	leader        string
+	following     following
+	stopFollowing context.CancelFunc
+
+	// commitMtx orders concurrent writes: sequence, queues of followers and CDC events get writes in same order
+	commitMtx sync.Mutex
+	// sequence is a number of last write, follower takes it from leader. Guarded by commitMtx
+	sequence uint64
+	// guarded by commitMtx and dataMtx: writes hold both, registration of follower holds dataMtx for writing
+	replicas map[*replica]struct{}
+
+	opts Options
+
+	done chan struct{}
+	// shutdown is closed by Shutdown, so streams which never end on their own return
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// Options configures storage
+type Options struct {
+	// IdempotencyRetention is a period during which results of create requests with idempotency keys are remembered
+	IdempotencyRetention time.Duration
+	// DefaultQuota is applied to users without own quota
+	DefaultQuota Quota
+	// Quotas by user
+	Quotas map[string]Quota
+	// TombstoneRetention is a period during which deleted records may be undeleted.
+	// Zero retention removes records on delete at once. Tombstones are accounted in usage until they are purged
+	TombstoneRetention time.Duration
+	// HistoryDepth is a max count of kept past versions of record, zero disables history.
+	// Past versions are accounted in bytes of usage of record owner and collection
+	HistoryDepth int
+	// HistoryMaxAge is a period during which replaced version is kept, zero means no limit
+	HistoryMaxAge time.Duration
+	// Compression of stored values, collections may override it
+	Compression Compression
+	// Dedup of stored values, stored blobs are read even if it is disabled
+	Dedup Dedup
+	// Keyring of encryption of stored values, nil disables encryption
+	Keyring *Keyring
+	// Leader is an address of leader to follow. Follower replaces its records by records of leader,
+	// applies writes of leader and rejects own writes until it is promoted. Empty means that node is a leader
+	Leader string
+	// PromoteAfter is a period of silence of leader after which follower promotes itself, zero disables it
+	PromoteAfter time.Duration
+	// LockStripes is a count of locks which serialize writes of records by hash of key, zero means 256.
+	// Single stripe serializes all writes
+	LockStripes int
+	// StatsInterval is a period of logging of Stats, zero disables logging
+	StatsInterval time.Duration
+}
 
-	cdcChannel chan *pbCDC.ListenResponse
+// cdcListener is a subscription of CDC events
+type cdcListener struct {
+	// closed on send failure
+	done chan struct{}
+	// empty collection means all collections
+	collection string
 }
 
 func (c *storageServer) Listen(request *pbCDC.ListenRequest, listener pbCDC.CDC_ListenServer) error {
 	c.listenersMtx.Lock()
-	ch := make(chan struct{})
-	c.listeners[listener] = ch
+	l := &cdcListener{done: make(chan struct{}), collection: request.GetCollection()}
+	c.listeners[listener] = l
 	c.listenersMtx.Unlock()
-	<-ch
-	return nil
+	var err error
+	select {
+	case <-l.done:
+		return nil
+	case <-listener.Context().Done():
+	case <-c.shutdown:
+		err = status.Errorf(codes.Unavailable, "storage is shutting down")
+	}
+	c.listenersMtx.Lock()
+	delete(c.listeners, listener)
+	c.listenersMtx.Unlock()
+	return err
 }
 
 func (c *storageServer) Create(ctx context.Context, request *pbCRUD.CreateRequest) (_ *pbCRUD.CreateResponse, err error) {
@@ -46,35 +161,20 @@ func (c *storageServer) Create(ctx context.Context, request *pbCRUD.CreateReques
 		}
 	}()
 
-	id, err := c.create(ctx, request.GetRaw())
+	id, version, err := c.create(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pbCRUD.CreateResponse{Id: id}, nil
+	return &pbCRUD.CreateResponse{Id: id, Version: version}, nil
 }
 
-func (c *storageServer) create(ctx context.Context, data []byte) (id string, err error) {
-	defer func() {
-		if err == nil {
-			c.notify(pbCDC.ListenResponse_Created, &pbCDC.Data{
-				Id:  id,
-				Raw: data,
-			})
-		}
-	}()
-
-	uuid, err := uuid.NewUUID()
-	if err != nil {
-		return "", status.Errorf(codes.Internal, err.Error())
-	}
-
-	c.dataMtx.Lock()
-	defer c.dataMtx.Unlock()
-
-	c.data[uuid.String()] = data
-
-	return uuid.String(), nil
+func (c *storageServer) create(ctx context.Context, request *pbCRUD.CreateRequest) (id string, version uint64, err error) {
+	err = c.write(ctx, func(t *tx) (err error) {
+		id, version, err = t.create(request)
+		return err
+	})
+	return id, version, err
 }
 
 func (c *storageServer) Read(ctx context.Context, request *pbCRUD.ReadRequest) (_ *pbCRUD.ReadResponse, err error) {
@@ -87,20 +187,44 @@ func (c *storageServer) Read(ctx context.Context, request *pbCRUD.ReadRequest) (
 		}
 	}()
 
-	data, err := c.read(ctx, request.GetId())
+	if request.GetAt() != nil {
+		return c.readAt(ctx, request.GetId(), request.GetAt().AsTime())
+	}
+
+	r, err := c.read(ctx, request.GetId())
 	if err != nil {
 		return nil, err
 	}
 
-	return &pbCRUD.ReadResponse{Raw: data}, nil
+	return readResponse(r), nil
+}
+
+func readResponse(r *Record) *pbCRUD.ReadResponse {
+	response := &pbCRUD.ReadResponse{Raw: r.Raw, Version: r.Version, Metadata: r.metadata()}
+	if !r.ExpiresAt.IsZero() {
+		response.Ttl = durationpb.New(time.Until(r.ExpiresAt))
+	}
+	return response
 }
 
-func (c *storageServer) read(ctx context.Context, id string) (data []byte, err error) {
+func (c *storageServer) read(ctx context.Context, id string) (_ *Record, err error) {
 	c.dataMtx.RLock()
 	defer c.dataMtx.RUnlock()
 
-	if data, ok := c.data[id]; ok {
-		return data, nil
+	name := collectionFromContext(ctx)
+	if _, err := c.collection(name); err != nil {
+		return nil, err
+	}
+	if isReservedID(id) {
+		return nil, status.Errorf(codes.NotFound, "")
+	}
+
+	r, ok, err := c.data.Get(recordKey(name, id))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	if ok && !r.expired(time.Now()) && !r.deleted() {
+		return r, nil
 	}
 
 	return nil, status.Errorf(codes.NotFound, "")
@@ -116,34 +240,69 @@ func (c *storageServer) Update(ctx context.Context, request *pbCRUD.UpdateReques
 		}
 	}()
 
-	err = c.update(ctx, request.GetData().GetId(), request.GetData().GetRaw())
+	version, err := c.update(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pbCRUD.UpdateResponse{}, nil
+	return &pbCRUD.UpdateResponse{Version: version}, nil
 }
 
-func (c *storageServer) update(ctx context.Context, id string, data []byte) (err error) {
+func (c *storageServer) update(ctx context.Context, request *pbCRUD.UpdateRequest) (version uint64, err error) {
+	err = c.write(ctx, func(t *tx) (err error) {
+		version, err = t.update(request)
+		return err
+	})
+	return version, err
+}
+
+func (c *storageServer) Patch(ctx context.Context, request *pbCRUD.PatchRequest) (_ *pbCRUD.PatchResponse, err error) {
+	log.Info().Caller().Msg("patch")
 	defer func() {
-		if err == nil {
-			c.notify(pbCDC.ListenResponse_Updated, &pbCDC.Data{
-				Id:  id,
-				Raw: data,
-			})
+		if err != nil {
+			log.Error().Caller().Msg("patch failed")
+		} else {
+			log.Info().Caller().Msg("patch done")
 		}
 	}()
 
-	c.dataMtx.Lock()
-	defer c.dataMtx.Unlock()
+	var version uint64
+	var raw []byte
+	err = c.write(ctx, func(t *tx) (err error) {
+		version, raw, err = t.patch(request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	if _, ok := c.data[id]; !ok {
-		return status.Errorf(codes.NotFound, "")
+	return &pbCRUD.PatchResponse{Version: version, Raw: raw}, nil
+}
+
+func (c *storageServer) Upsert(ctx context.Context, request *pbCRUD.UpsertRequest) (_ *pbCRUD.UpsertResponse, err error) {
+	log.Info().Caller().Msg("upsert")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("upsert failed")
+		} else {
+			log.Info().Caller().Msg("upsert done")
+		}
+	}()
+
+	version, created, err := c.upsert(ctx, request)
+	if err != nil {
+		return nil, err
 	}
 
-	c.data[id] = data
+	return &pbCRUD.UpsertResponse{Version: version, Created: created}, nil
+}
 
-	return nil
+func (c *storageServer) upsert(ctx context.Context, request *pbCRUD.UpsertRequest) (version uint64, created bool, err error) {
+	err = c.write(ctx, func(t *tx) (err error) {
+		version, created, err = t.upsert(request)
+		return err
+	})
+	return version, created, err
 }
 
 func (c *storageServer) Delete(ctx context.Context, request *pbCRUD.DeleteRequest) (_ *pbCRUD.DeleteResponse, err error) {
@@ -156,7 +315,7 @@ func (c *storageServer) Delete(ctx context.Context, request *pbCRUD.DeleteReques
 		}
 	}()
 
-	err = c.delete(ctx, request.GetId())
+	err = c.delete(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -164,56 +323,442 @@ func (c *storageServer) Delete(ctx context.Context, request *pbCRUD.DeleteReques
 	return &pbCRUD.DeleteResponse{}, nil
 }
 
-func (c *storageServer) delete(ctx context.Context, id string) (err error) {
+func (c *storageServer) delete(ctx context.Context, request *pbCRUD.DeleteRequest) (err error) {
+	return c.write(ctx, func(t *tx) error {
+		return t.delete(request)
+	})
+}
+
+func (c *storageServer) Undelete(ctx context.Context, request *pbCRUD.UndeleteRequest) (_ *pbCRUD.UndeleteResponse, err error) {
+	log.Info().Caller().Msg("undelete")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("undelete failed")
+		} else {
+			log.Info().Caller().Msg("undelete done")
+		}
+	}()
+
+	version, err := c.undelete(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.UndeleteResponse{Version: version}, nil
+}
+
+func (c *storageServer) undelete(ctx context.Context, request *pbCRUD.UndeleteRequest) (version uint64, err error) {
+	err = c.write(ctx, func(t *tx) (err error) {
+		version, err = t.undelete(request)
+		return err
+	})
+	return version, err
+}
+
+func (c *storageServer) Purge(ctx context.Context, request *pbCRUD.PurgeRequest) (_ *pbCRUD.PurgeResponse, err error) {
+	log.Info().Caller().Msg("purge")
 	defer func() {
-		if err == nil {
-			c.notify(pbCDC.ListenResponse_Deleted, &pbCDC.Data{
-				Id: id,
-			})
+		if err != nil {
+			log.Error().Caller().Msg("purge failed")
+		} else {
+			log.Info().Caller().Msg("purge done")
 		}
 	}()
 
+	err = c.purge(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.PurgeResponse{}, nil
+}
+
+func (c *storageServer) purge(ctx context.Context, request *pbCRUD.PurgeRequest) (err error) {
+	return c.write(ctx, func(t *tx) error {
+		return t.purge(request)
+	})
+}
+
+func (c *storageServer) Batch(ctx context.Context, request *pbCRUD.BatchRequest) (_ *pbCRUD.BatchResponse, err error) {
+	log.Info().Caller().Int("operations", len(request.GetOperations())).Msg("batch")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("batch failed")
+		} else {
+			log.Info().Caller().Msg("batch done")
+		}
+	}()
+
+	results, err := c.batch(ctx, request.GetOperations())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.BatchResponse{Results: results}, nil
+}
+
+// batch applies all operations in one transaction. Error of operation keeps its code and is prefixed by operation index
+func (c *storageServer) batch(ctx context.Context, operations []*pbCRUD.Operation) (results []*pbCRUD.OperationResult, err error) {
+	err = c.write(ctx, func(t *tx) error {
+		results = make([]*pbCRUD.OperationResult, 0, len(operations))
+		for i, op := range operations {
+			result, err := t.apply(op)
+			if err != nil {
+				s := status.Convert(err)
+				return status.Errorf(s.Code(), "operation %d: %s", i, s.Message())
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (c *storageServer) List(ctx context.Context, request *pbCRUD.ListRequest) (_ *pbCRUD.ListResponse, err error) {
+	log.Info().Caller().Msg("list")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("list failed")
+		} else {
+			log.Info().Caller().Msg("list done")
+		}
+	}()
+
+	after, err := decodePageToken(request.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	items, next, err := c.list(ctx, request.GetPrefix(), after, pageSize(request.GetPageSize()), request.GetIncludeDeleted())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbCRUD.ListResponse{Items: items, NextPageToken: encodePageToken(next)}, nil
+}
+
+// list returns up to limit records with prefix which ids are greater than after, tombstones are returned if deleted is set.
+// next is an id of last returned record if more records left, otherwise empty
+func (c *storageServer) list(ctx context.Context, prefix, after string, limit int, deleted bool) (items []*pbCRUD.Data, next string, err error) {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	name := collectionFromContext(ctx)
+	if _, err := c.collection(name); err != nil {
+		return nil, "", err
+	}
+
+	// one more id tells that more records left
+	matched := c.keys.after(name, prefix, after, limit+1)
+	if len(matched) > limit {
+		matched = matched[:limit]
+		next = matched[limit-1]
+	}
+
+	now := time.Now()
+	items = make([]*pbCRUD.Data, 0, len(matched))
+	for _, id := range matched {
+		r, ok, err := c.data.Get(recordKey(name, id))
+		if err != nil {
+			return nil, "", status.Errorf(codes.Internal, err.Error())
+		}
+		if !ok || r.expired(now) || (r.deleted() && !deleted) {
+			continue
+		}
+		items = append(items, &pbCRUD.Data{
+			Id:       id,
+			Raw:      r.Raw,
+			Version:  r.Version,
+			Metadata: r.metadata(),
+		})
+	}
+
+	return items, next, nil
+}
+
+// write runs f in transaction of records. Transaction holds dataMtx for reading and locks stripes of keys
+// on first access, so writes of unrelated keys run in parallel. Mutations of transaction are committed to backend
+// if f succeeds, CDC events are published after commit in order of commits
+func (c *storageServer) write(ctx context.Context, f func(t *tx) error) error {
+	c.dataMtx.RLock()
+	defer c.dataMtx.RUnlock()
+
+	var wanted []int
+	for {
+		locks := c.stripes.lockAll(wanted)
+		err := c.commit(ctx, f, locks)
+		locks.unlock()
+		if !locks.busy() {
+			return err
+		}
+		// transaction is restarted with all its known stripes locked in order
+		wanted = locks.wanted()
+	}
+}
+
+// alter runs f in transaction which holds dataMtx for writing: changes of collections, indexes and keys
+// see all records and no write of records runs concurrently
+func (c *storageServer) alter(ctx context.Context, f func(t *tx) error) error {
 	c.dataMtx.Lock()
 	defer c.dataMtx.Unlock()
 
-	delete(c.data, id)
+	return c.commit(ctx, f, nil)
+}
+
+// commit runs f in transaction and applies its mutations. Caller holds dataMtx, locks are nil
+// if it is held for writing
+func (c *storageServer) commit(ctx context.Context, f func(t *tx) error, locks *stripeLocks) error {
+	if c.leader != "" {
+		return c.notLeaderError()
+	}
+	t := newTx(ctx, c.data, c.opts.IdempotencyRetention, c.opts.TombstoneRetention)
+	t.locks = locks
+	settings, err := c.collection(t.collection)
+	if err != nil {
+		return err
+	}
+	t.settings = settings
+	if err := f(t); err != nil {
+		t.undo()
+		return err
+	}
+	if err := c.archive(t); err != nil {
+		t.undo()
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	mutations := t.mutations()
+	if len(mutations) > 0 {
+		d, err := c.usageDelta(mutations)
+		if err != nil {
+			t.undo()
+			return status.Errorf(codes.Internal, err.Error())
+		}
+		if err := c.reserve(mutations, d); err != nil {
+			t.undo()
+			return err
+		}
+		if err := c.apply(mutations); err != nil {
+			c.account(d, -1)
+			t.undo()
+			return status.Errorf(codes.Internal, err.Error())
+		}
+	}
+	for _, f := range t.commit {
+		f()
+	}
+	if len(mutations) == 0 && len(t.events) == 0 {
+		return nil
+	}
+
+	c.commitMtx.Lock()
+	defer c.commitMtx.Unlock()
 
+	if len(mutations) > 0 {
+		c.sequence++
+		c.replicate(mutations, t.events)
+	}
+	c.publish(t.events)
 	return nil
 }
 
-func (c *storageServer) notify(event pbCDC.ListenResponse_EventType, data *pbCDC.Data) {
-	c.cdcChannel <- &pbCDC.ListenResponse{
-		Event: event,
-		Data:  data,
+// apply commits mutations to backend and updates expirations and indexes. Caller holds dataMtx
+// and stripes of mutations
+func (c *storageServer) apply(mutations []Mutation) error {
+	if err := c.data.Apply(mutations...); err != nil {
+		return err
+	}
+	for _, m := range mutations {
+		if m.Record != nil {
+			c.scheduleRecord(m.ID, m.Record)
+			c.keys.add(m.ID)
+		} else {
+			c.keys.remove(m.ID)
+		}
+	}
+	c.reindex(mutations)
+	return nil
+}
+
+// publish queues CDC events for listeners, so slow listeners do not block writes
+func (c *storageServer) publish(events []*pbCDC.ListenResponse) {
+	if len(events) == 0 {
+		return
+	}
+	c.eventsMtx.Lock()
+	c.events = append(c.events, events...)
+	c.eventsMtx.Unlock()
+	select {
+	case c.eventsWake <- struct{}{}:
+	default:
 	}
 }
 
 func (c *storageServer) sendChanges() {
-	for msg := range c.cdcChannel {
-		var listenersToDelete []pbCDC.CDC_ListenServer
-		c.listenersMtx.RLock()
-		for l, ch := range c.listeners {
-			if err := l.Send(msg); err != nil {
-				listenersToDelete = append(listenersToDelete, l)
-				close(ch)
-			}
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.eventsWake:
+		}
+		c.eventsMtx.Lock()
+		events := c.events
+		c.events = nil
+		c.sending = len(events)
+		c.eventsMtx.Unlock()
+		for _, msg := range events {
+			c.send(msg)
+			c.eventsMtx.Lock()
+			c.sending--
+			c.eventsMtx.Unlock()
 		}
-		c.listenersMtx.RUnlock()
+	}
+}
 
-		c.listenersMtx.Lock()
-		for _, l := range listenersToDelete {
-			delete(c.listeners, l)
+// send delivers CDC event to listeners of its collection, failed listeners are unsubscribed
+func (c *storageServer) send(msg *pbCDC.ListenResponse) {
+	var listenersToDelete []pbCDC.CDC_ListenServer
+	c.listenersMtx.RLock()
+	for l, ll := range c.listeners {
+		if ll.collection != "" && ll.collection != msg.GetCollection() {
+			continue
+		}
+		if err := l.Send(msg); err != nil {
+			listenersToDelete = append(listenersToDelete, l)
+			close(ll.done)
 		}
-		c.listenersMtx.Unlock()
 	}
+	c.listenersMtx.RUnlock()
+	if len(listenersToDelete) == 0 {
+		return
+	}
+
+	c.listenersMtx.Lock()
+	for _, l := range listenersToDelete {
+		delete(c.listeners, l)
+	}
+	c.listenersMtx.Unlock()
+}
+
+// Shutdown ends CDC and replication streams, so gRPC server stops gracefully. New streams end at once
+func (c *storageServer) Shutdown() {
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+// Close stops background jobs and releases backend of storage
+func (c *storageServer) Close() error {
+	c.Shutdown()
+	close(c.done)
+
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	if c.stopFollowing != nil {
+		c.stopFollowing()
+	}
+
+	return c.data.Close()
 }
 
-func New() *storageServer {
+func New(backend Backend, opts Options) (*storageServer, error) {
 	s := &storageServer{
-		data:       make(map[string][]byte),
-		listeners:  make(map[pbCDC.CDC_ListenServer]chan struct{}, 0),
-		cdcChannel: make(chan *pbCDC.ListenResponse, 10),
+		listeners:  make(map[pbCDC.CDC_ListenServer]*cdcListener, 0),
+		eventsWake: make(chan struct{}, 1),
+		operations: make(map[string]*operationStats),
+		stripes:    newStripes(opts.LockStripes),
+
+		expirationsWake:  make(chan struct{}, 1),
+		indexes:          make(map[string]*index),
+		keys:             newRecordKeys(),
+		usage:            newUsageCounters(),
+		collections:      make(map[string]*collection),
+		collectionsUsage: newUsageCounters(),
+		replicas:         make(map[*replica]struct{}),
+		opts:             opts,
+		rotations:        make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		shutdown:         make(chan struct{}),
+	}
+	if tier, ok := backend.(*tieredBackend); ok {
+		s.tier = tier
+	}
+	if opts.Keyring != nil {
+		encryptor, err := newEncryptingBackend(backend, opts.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		s.encryptor = encryptor
+		backend = encryptor
+	}
+	s.compressor = newCompressingBackend(backend, s.compression)
+	s.deduper = newDedupingBackend(s.compressor, opts.Dedup)
+	s.data = s.deduper
+	if err := s.loadEncryption(); err != nil {
+		return nil, err
+	}
+	if err := s.compressor.loadStats(); err != nil {
+		log.Error().Caller().Err(err).Msg("load compression stats failed")
+	}
+	if err := s.deduper.load(); err != nil {
+		log.Error().Caller().Err(err).Msg("load blobs failed")
+	}
+	if err := s.loadCollections(); err != nil {
+		log.Error().Caller().Err(err).Msg("load collections failed")
+	}
+	if err := s.load(); err != nil {
+		log.Error().Caller().Err(err).Msg("load records failed")
+	}
+	if err := s.loadIndexes(); err != nil {
+		log.Error().Caller().Err(err).Msg("load indexes failed")
+	}
+	if opts.Leader != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.leader = opts.Leader
+		s.following.lastContact = time.Now()
+		s.stopFollowing = cancel
+		go s.follow(ctx, opts.Leader)
+		if opts.PromoteAfter > 0 {
+			go s.watchLeader(ctx)
+		}
 	}
 	go s.sendChanges()
-	return s
+	go s.expire()
+	go s.rotate()
+	if opts.StatsInterval > 0 {
+		go s.logStats()
+	}
+	return s, nil
+}
+
+// load schedules expirations and purges and accounts usage of stored records
+func (c *storageServer) load() error {
+	c.dataMtx.Lock()
+	defer c.dataMtx.Unlock()
+
+	ids, err := c.data.Keys()
+	if err != nil {
+		return err
+	}
+	d := newUsageDeltas()
+	for _, id := range ids {
+		if !accounted(id) {
+			continue
+		}
+		r, ok, err := c.data.Get(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if !isSystemID(id) || strings.HasPrefix(id, idempotencyIDPrefix) {
+			c.scheduleRecord(id, r)
+		}
+		c.keys.add(id)
+		d.add(id, r, 1)
+	}
+	c.account(d, 1)
+
+	return nil
 }
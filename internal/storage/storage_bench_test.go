@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// Benchmarks compare striped write path with reference write path which holds dataMtx for writing,
+// as every write did before lock striping:
+//
+//	go test ./internal/storage -run '^$' -bench . -cpu 1,8
+//
+// Both paths run the same transactions over the same backends, so difference is a cost of global lock
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+}
+
+var benchmarkRaw = []byte(`{"name":"benchmark","tags":["a","b","c"],"count":42}`)
+
+// writePath runs write transaction of storage
+type writePath func(s *storageServer, ctx context.Context, f func(t *tx) error) error
+
+// globalLockWrite is a reference write path before lock striping: transaction holds dataMtx for writing,
+// so writes of all keys are serialized and reads wait for every write
+func globalLockWrite(s *storageServer, ctx context.Context, f func(t *tx) error) error {
+	return s.alter(ctx, f)
+}
+
+func stripedWrite(s *storageServer, ctx context.Context, f func(t *tx) error) error {
+	return s.write(ctx, f)
+}
+
+// benchmarkStorage runs f over storage of every backend with reference and striped write path
+func benchmarkStorage(b *testing.B, f func(b *testing.B, s *storageServer, write writePath)) {
+	backends := []struct {
+		name string
+		new  func(b *testing.B) Backend
+	}{
+		{name: "memory", new: func(b *testing.B) Backend { return NewMemoryBackend() }},
+		{name: "file", new: func(b *testing.B) Backend {
+			fb, err := NewFileBackend(b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			return fb
+		}},
+	}
+	paths := []struct {
+		name  string
+		write writePath
+	}{
+		{name: "global-lock", write: globalLockWrite},
+		{name: "striped", write: stripedWrite},
+	}
+	for _, backend := range backends {
+		for _, path := range paths {
+			b.Run(backend.name+"/"+path.name, func(b *testing.B) {
+				s, err := New(backend.new(b), Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer s.Close()
+				// file backend waits for disk, so it takes more writers than CPUs to load it
+				b.SetParallelism(4)
+				f(b, s, path.write)
+			})
+		}
+	}
+}
+
+func benchmarkCreate(s *storageServer, write writePath, ctx context.Context, request *pbCRUD.CreateRequest) (id string, err error) {
+	err = write(s, ctx, func(t *tx) (err error) {
+		id, _, err = t.create(request)
+		return err
+	})
+	return id, err
+}
+
+func benchmarkUpdate(s *storageServer, write writePath, ctx context.Context, id string) error {
+	return write(s, ctx, func(t *tx) error {
+		_, err := t.update(&pbCRUD.UpdateRequest{Data: &pbCRUD.Data{Id: id, Raw: benchmarkRaw}})
+		return err
+	})
+}
+
+func BenchmarkCreate(b *testing.B) {
+	benchmarkStorage(b, func(b *testing.B, s *storageServer, write writePath) {
+		ctx := context.Background()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := benchmarkCreate(s, write, ctx, &pbCRUD.CreateRequest{Raw: benchmarkRaw}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	benchmarkStorage(b, func(b *testing.B, s *storageServer, write writePath) {
+		ctx := context.Background()
+		var writers int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			// every writer updates own record, so writers do not wait for each other on same key
+			id := "update-" + strconv.FormatInt(atomic.AddInt64(&writers, 1), 10)
+			if _, err := benchmarkCreate(s, write, ctx, &pbCRUD.CreateRequest{Id: id, Raw: benchmarkRaw}); err != nil {
+				b.Error(err)
+				return
+			}
+			for pb.Next() {
+				if err := benchmarkUpdate(s, write, ctx, id); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkReadWrite reads random records while every tenth operation updates one, so reads wait for writes
+// which hold global lock
+func BenchmarkReadWrite(b *testing.B) {
+	benchmarkStorage(b, func(b *testing.B, s *storageServer, write writePath) {
+		ctx := context.Background()
+		ids := make([]string, 1000)
+		for i := range ids {
+			id, err := benchmarkCreate(s, write, ctx, &pbCRUD.CreateRequest{Raw: benchmarkRaw})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids[i] = id
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			rnd := rand.New(rand.NewSource(rand.Int63()))
+			for n := 0; pb.Next(); n++ {
+				id := ids[rnd.Intn(len(ids))]
+				if n%10 == 0 {
+					if err := benchmarkUpdate(s, write, ctx, id); err != nil {
+						b.Error(err)
+						return
+					}
+					continue
+				}
+				if _, err := s.Read(ctx, &pbCRUD.ReadRequest{Id: id}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkStorage(b, func(b *testing.B, s *storageServer, write writePath) {
+		ctx := context.Background()
+		ids := make([]string, 1000)
+		for i := range ids {
+			id, err := benchmarkCreate(s, write, ctx, &pbCRUD.CreateRequest{Raw: benchmarkRaw})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids[i] = id
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			rnd := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				if _, err := s.Read(ctx, &pbCRUD.ReadRequest{Id: ids[rnd.Intn(len(ids))]}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
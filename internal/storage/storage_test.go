@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// failingBackend fails writes while fail is set
+type failingBackend struct {
+	Backend
+	fail atomic.Bool
+}
+
+func (b *failingBackend) Apply(mutations ...Mutation) error {
+	if b.fail.Load() {
+		return errors.New("backend failed")
+	}
+	return b.Backend.Apply(mutations...)
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	create := func(id string) *pbCRUD.Operation {
+		return &pbCRUD.Operation{Op: &pbCRUD.Operation_Create{Create: &pbCRUD.CreateRequest{Id: id, Raw: []byte(`"` + id + `"`)}}}
+	}
+	update := func(id string, expectedVersion uint64) *pbCRUD.Operation {
+		return &pbCRUD.Operation{Op: &pbCRUD.Operation_Update{Update: &pbCRUD.UpdateRequest{
+			Data:            &pbCRUD.Data{Id: id, Raw: []byte(`"updated"`)},
+			ExpectedVersion: expectedVersion,
+		}}}
+	}
+	remove := func(id string) *pbCRUD.Operation {
+		return &pbCRUD.Operation{Op: &pbCRUD.Operation_Delete{Delete: &pbCRUD.DeleteRequest{Id: id}}}
+	}
+
+	tests := []struct {
+		name        string
+		operations  []*pbCRUD.Operation
+		failBackend bool
+		code        codes.Code
+		prefix      string
+	}{
+		{
+			name:       "create of existing record",
+			operations: []*pbCRUD.Operation{create("b"), update("a", 0), create("a")},
+			code:       codes.AlreadyExists,
+			prefix:     "operation 2:",
+		},
+		{
+			name:       "update of missing record",
+			operations: []*pbCRUD.Operation{remove("a"), create("b"), update("c", 0)},
+			code:       codes.NotFound,
+			prefix:     "operation 2:",
+		},
+		{
+			name:       "version mismatch",
+			operations: []*pbCRUD.Operation{create("b"), update("a", 2)},
+			code:       codes.FailedPrecondition,
+			prefix:     "operation 1:",
+		},
+		{
+			name:       "record created by batch is updated with wrong version",
+			operations: []*pbCRUD.Operation{create("b"), update("b", 1), update("b", 1)},
+			code:       codes.FailedPrecondition,
+			prefix:     "operation 2:",
+		},
+		{
+			name:        "backend failure",
+			operations:  []*pbCRUD.Operation{create("b"), update("a", 1), remove("a")},
+			failBackend: true,
+			code:        codes.Internal,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &failingBackend{Backend: NewMemoryBackend()}
+			s, err := New(backend, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			ctx := context.Background()
+
+			if _, err := s.Create(ctx, &pbCRUD.CreateRequest{Id: "a", Raw: []byte(`"a"`)}); err != nil {
+				t.Fatal(err)
+			}
+			backend.fail.Store(test.failBackend)
+			_, err = s.Batch(ctx, &pbCRUD.BatchRequest{Operations: test.operations})
+			if status.Code(err) != test.code || !strings.HasPrefix(status.Convert(err).Message(), test.prefix) {
+				t.Fatalf("batch: %v, want %v with prefix '%s'", err, test.code, test.prefix)
+			}
+			backend.fail.Store(false)
+
+			// nothing of failed batch is visible
+			a, err := s.Read(ctx, &pbCRUD.ReadRequest{Id: "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(a.GetRaw()) != `"a"` || a.GetVersion() != 1 {
+				t.Errorf("record 'a' is %s of version %d, want \"a\" of version 1", a.GetRaw(), a.GetVersion())
+			}
+			if _, err := s.Read(ctx, &pbCRUD.ReadRequest{Id: "b"}); status.Code(err) != codes.NotFound {
+				t.Errorf("read 'b': %v, want NotFound", err)
+			}
+			list, err := s.List(ctx, &pbCRUD.ListRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.GetItems()) != 1 || list.GetItems()[0].GetId() != "a" {
+				t.Errorf("list %v, want 'a' only", list.GetItems())
+			}
+			usage, err := s.GetUsage(ctx, &pbCRUD.GetUsageRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.GetRecords() != 1 || usage.GetBytes() != 3 {
+				t.Errorf("usage %d records of %d bytes, want 1 record of 3 bytes", usage.GetRecords(), usage.GetBytes())
+			}
+
+			// batch succeeds after failed one, so its locks and reservations are released
+			if _, err := s.Batch(ctx, &pbCRUD.BatchRequest{Operations: []*pbCRUD.Operation{create("b"), update("a", 1)}}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+const (
+	defaultChunkSize = 64 << 10
+	maxChunkSize     = 1 << 20
+)
+
+func (c *storageServer) Upload(stream pbCRUD.CRUD_UploadServer) (err error) {
+	log.Info().Caller().Msg("upload")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("upload failed")
+		} else {
+			log.Info().Caller().Msg("upload done")
+		}
+	}()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Errorf(codes.InvalidArgument, "first message of upload must be header")
+	}
+
+	// owner and collection quotas are checked on commit, but oversized upload is rejected early to not buffer it whole
+	user := userFromContext(stream.Context())
+	userQuota := c.quota(user)
+	var collectionQuota Quota
+	name := collectionFromContext(stream.Context())
+	c.dataMtx.RLock()
+	settings, err := c.collection(name)
+	c.dataMtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	if settings != nil {
+		collectionQuota = settings.Quota
+	}
+
+	var raw bytes.Buffer
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk, ok := msg.GetPart().(*pbCRUD.UploadRequest_Chunk)
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "header must be sent once")
+		}
+		raw.Write(chunk.Chunk)
+		if user != "" {
+			if err := checkObjectSize(userOwner(user), userQuota, uint64(raw.Len())); err != nil {
+				return err
+			}
+		}
+		if err := checkObjectSize(collectionOwner(name), collectionQuota, uint64(raw.Len())); err != nil {
+			return err
+		}
+	}
+
+	request := proto.Clone(header).(*pbCRUD.CreateRequest)
+	request.Raw = raw.Bytes()
+
+	id, version, err := c.create(stream.Context(), request)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&pbCRUD.CreateResponse{Id: id, Version: version})
+}
+
+func (c *storageServer) Download(request *pbCRUD.DownloadRequest, stream pbCRUD.CRUD_DownloadServer) (err error) {
+	log.Info().Caller().Msg("download")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("download failed")
+		} else {
+			log.Info().Caller().Msg("download done")
+		}
+	}()
+
+	r, err := c.read(stream.Context(), request.GetId())
+	if err != nil {
+		return err
+	}
+
+	header := readResponse(r)
+	header.Raw = nil
+	if err := stream.Send(&pbCRUD.DownloadResponse{Part: &pbCRUD.DownloadResponse_Header{Header: header}}); err != nil {
+		return err
+	}
+
+	chunkSize := int(request.GetChunkSize())
+	switch {
+	case chunkSize == 0:
+		chunkSize = defaultChunkSize
+	case chunkSize > maxChunkSize:
+		chunkSize = maxChunkSize
+	}
+
+	// records are never modified in place, so raw is safe to send without lock
+	for raw := r.Raw; len(raw) > 0; {
+		n := chunkSize
+		if n > len(raw) {
+			n = len(raw)
+		}
+		if err := stream.Send(&pbCRUD.DownloadResponse{Part: &pbCRUD.DownloadResponse_Chunk{Chunk: raw[:n]}}); err != nil {
+			return err
+		}
+		raw = raw[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// defaultLockStripes is a count of lock stripes if Options.LockStripes is zero
+const defaultLockStripes = 256
+
+// errLockOrder aborts transaction which needs stripe lower than already locked one while that stripe is busy
+var errLockOrder = errors.New("stripe is busy and locked out of order")
+
+// stripes serialize writes of records by hash of backend key, so writes of keys of different stripes
+// run in parallel. History and version records share stripe with their record
+type stripes []sync.Mutex
+
+func newStripes(n int) stripes {
+	if n <= 0 {
+		n = defaultLockStripes
+	}
+	return make(stripes, n)
+}
+
+// of returns stripe of backend key
+func (s stripes) of(key string) int {
+	if owner, ok := historyOwner(key); ok {
+		key = owner
+	}
+	return int(hashKey(key) % uint32(len(s)))
+}
+
+// hashKey is FNV-1a of key, it is computed inline because hash.Hash32 escapes to heap on every write
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// all returns ids of all stripes, transaction which locks them excludes writes of records
+func (s stripes) all() []int {
+	ids := make([]int, len(s))
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+// lockAll locks stripes in ascending order
+func (s stripes) lockAll(ids []int) *stripeLocks {
+	l := &stripeLocks{stripes: s, missed: -1}
+	sort.Ints(ids)
+	for _, i := range ids {
+		if n := len(l.held); n > 0 && l.held[n-1] == i {
+			continue
+		}
+		s[i].Lock()
+		l.held = append(l.held, i)
+	}
+	return l
+}
+
+// stripeLocks is a set of stripes locked by one transaction. Stripes are locked in ascending order,
+// so transactions which touch several keys do not deadlock: stripe lower than already locked one is only tried,
+// and transaction is restarted with all its stripes locked upfront if that stripe is busy
+type stripeLocks struct {
+	stripes stripes
+	// locked stripes in ascending order
+	held []int
+	// missed is a busy stripe which was tried out of order, negative if there is none
+	missed int
+}
+
+// lock locks stripe of backend key until unlock
+func (l *stripeLocks) lock(key string) error {
+	i := l.stripes.of(key)
+	n := sort.SearchInts(l.held, i)
+	if n < len(l.held) && l.held[n] == i {
+		return nil
+	}
+	if n < len(l.held) {
+		if !l.stripes[i].TryLock() {
+			l.missed = i
+			return errLockOrder
+		}
+	} else {
+		l.stripes[i].Lock()
+	}
+	l.held = append(l.held, 0)
+	copy(l.held[n+1:], l.held[n:])
+	l.held[n] = i
+	return nil
+}
+
+func (l *stripeLocks) unlock() {
+	for _, i := range l.held {
+		l.stripes[i].Unlock()
+	}
+}
+
+// busy is true if transaction is aborted by stripe locked out of order
+func (l *stripeLocks) busy() bool {
+	return l.missed >= 0
+}
+
+// wanted returns stripes which restarted transaction locks upfront
+func (l *stripeLocks) wanted() []int {
+	return append(append([]int(nil), l.held...), l.missed)
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pbAdmin "github.com/amasynikov/grpc-webinar/internal/genproto/admin"
+)
+
+// tierCompactionMinGarbage is a min size of dead values in spill file which is worth compaction
+const tierCompactionMinGarbage = 64 << 20
+
+// tieredEntry is a record which value is resident in memory, spilled to disk or both
+type tieredEntry struct {
+	id string
+	// record with value, Raw is nil while value is evicted
+	record *Record
+	// element of LRU list, nil while value is evicted
+	element *list.Element
+	// location of value in spill file, offset is negative if value is not spilled
+	offset int64
+	length int64
+}
+
+type tierStats struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// tieredBackend keeps ids and metadata of all records in memory and values within memory budget.
+// Least recently used values are evicted to spill file and are read back on access.
+// Spill file is a cache of values only, it is removed on close
+type tieredBackend struct {
+	// Get reorders LRU list, so it is guarded by own mutex
+	mtx sync.Mutex
+
+	data   map[string]*tieredEntry
+	lru    list.List
+	budget uint64
+	// resident is a size of values in memory
+	resident uint64
+
+	dir  string
+	file *os.File
+	// size of spill file and size of dead values in it
+	fileSize int64
+	garbage  int64
+
+	stats tierStats
+}
+
+// NewTieredBackend makes backend which keeps records in memory, values over budget in bytes are evicted
+// to spill file in dir
+func NewTieredBackend(dir string, budget uint64) (*tieredBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "tier-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &tieredBackend{
+		data:   make(map[string]*tieredEntry),
+		budget: budget,
+		dir:    dir,
+		file:   file,
+	}, nil
+}
+
+func (b *tieredBackend) Get(id string) (*Record, bool, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e, ok := b.data[id]
+	if !ok {
+		return nil, false, nil
+	}
+	if e.element != nil {
+		b.stats.hits++
+		b.lru.MoveToFront(e.element)
+		return e.record, true, nil
+	}
+
+	b.stats.misses++
+	raw := make([]byte, e.length)
+	if _, err := b.file.ReadAt(raw, e.offset); err != nil {
+		return nil, false, err
+	}
+	r := *e.record
+	r.Raw = raw
+	e.record = &r
+	b.admit(e)
+	if err := b.evict(); err != nil {
+		return nil, false, err
+	}
+	// value over budget is evicted at once, so loaded copy is returned instead of entry record
+	return &r, true, nil
+}
+
+func (b *tieredBackend) Apply(mutations ...Mutation) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, m := range mutations {
+		if old, ok := b.data[m.ID]; ok {
+			b.remove(old)
+		}
+		if m.Record == nil {
+			continue
+		}
+		e := &tieredEntry{id: m.ID, record: m.Record, offset: -1}
+		b.data[m.ID] = e
+		b.admit(e)
+	}
+	if err := b.evict(); err != nil {
+		return err
+	}
+	return b.compact()
+}
+
+// admit makes value of entry resident as the most recently used one
+func (b *tieredBackend) admit(e *tieredEntry) {
+	e.element = b.lru.PushFront(e)
+	b.resident += uint64(len(e.record.Raw))
+}
+
+// remove drops entry from memory and marks its spilled value as garbage
+func (b *tieredBackend) remove(e *tieredEntry) {
+	if e.element != nil {
+		b.lru.Remove(e.element)
+		b.resident -= uint64(len(e.record.Raw))
+	}
+	if e.offset >= 0 {
+		b.garbage += e.length
+	}
+	delete(b.data, e.id)
+}
+
+// evict spills least recently used values until resident values fit into budget
+func (b *tieredBackend) evict() error {
+	for b.resident > b.budget {
+		back := b.lru.Back()
+		if back == nil {
+			return nil
+		}
+		e := back.Value.(*tieredEntry)
+		// value is written once, record is replaced on every change
+		if e.offset < 0 {
+			if _, err := b.file.WriteAt(e.record.Raw, b.fileSize); err != nil {
+				return err
+			}
+			e.offset, e.length = b.fileSize, int64(len(e.record.Raw))
+			b.fileSize += e.length
+		}
+		b.lru.Remove(back)
+		e.element = nil
+		b.resident -= uint64(len(e.record.Raw))
+		r := *e.record
+		r.Raw = nil
+		e.record = &r
+		b.stats.evictions++
+	}
+	return nil
+}
+
+// compact rewrites spill file without dead values when they take most of it.
+// Spilled copies of resident values are dropped
+func (b *tieredBackend) compact() error {
+	if b.garbage < tierCompactionMinGarbage || b.garbage < b.fileSize/2 {
+		return nil
+	}
+	file, err := os.CreateTemp(b.dir, "tier-*.spill")
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, e := range b.data {
+		if e.offset < 0 {
+			continue
+		}
+		if e.element != nil {
+			e.offset = -1
+			continue
+		}
+		raw := make([]byte, e.length)
+		if _, err := b.file.ReadAt(raw, e.offset); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		if _, err := file.WriteAt(raw, size); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		e.offset = size
+		size += e.length
+	}
+	log.Info().Caller().Int64("before", b.fileSize).Int64("after", size).Msg("spill file compacted")
+	b.file.Close()
+	os.Remove(b.file.Name())
+	b.file, b.fileSize, b.garbage = file, size, 0
+	return nil
+}
+
+func (b *tieredBackend) Keys() ([]string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	ids := make([]string, 0, len(b.data))
+	for id := range b.data {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (b *tieredBackend) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if err := b.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(b.file.Name())
+}
+
+func (c *storageServer) MemoryStats(ctx context.Context, request *pbAdmin.MemoryStatsRequest) (_ *pbAdmin.MemoryStatsResponse, err error) {
+	log.Info().Caller().Msg("memory stats")
+	defer func() {
+		if err != nil {
+			log.Error().Caller().Msg("memory stats failed")
+		} else {
+			log.Info().Caller().Msg("memory stats done")
+		}
+	}()
+
+	if c.tier == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "memory budget is disabled")
+	}
+
+	b := c.tier
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	response := &pbAdmin.MemoryStatsResponse{
+		Budget:          b.budget,
+		ResidentBytes:   b.resident,
+		ResidentRecords: uint64(b.lru.Len()),
+		EvictedRecords:  uint64(len(b.data) - b.lru.Len()),
+		SpillFileBytes:  uint64(b.fileSize),
+		Hits:            b.stats.hits,
+		Misses:          b.stats.misses,
+		Evictions:       b.stats.evictions,
+	}
+	if reads := b.stats.hits + b.stats.misses; reads > 0 {
+		response.HitRatio = float64(b.stats.hits) / float64(reads)
+	}
+	return response, nil
+}
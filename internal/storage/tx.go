@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pbCDC "github.com/amasynikov/grpc-webinar/internal/genproto/cdc"
+	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
+)
+
+// tx stages mutations over backend. Reads of tx see staged mutations.
+// Staged mutations are applied to backend at once on commit, CDC events are published after commit only.
+// tx of records holds dataMtx for reading and locks stripe of every key before its first access,
+// tx of schema changes holds dataMtx for writing and locks nothing
+type tx struct {
+	data Backend
+	// retention of results of create requests with idempotency keys, zero retention does not keep them
+	idempotencyRetention time.Duration
+	// nil if tx holds dataMtx for writing
+	locks *stripeLocks
+	now   time.Time
+	// user on which behalf transaction is made
+	user string
+	// retention of tombstones of deleted records, zero retention removes records at once
+	retention time.Duration
+	// collection of transaction records, empty for default collection
+	collection string
+	// settings of collection, nil for default collection
+	settings *collection
+
+	// rollback hooks undo side effects of transaction which is not committed
+	rollback []func()
+	// commit hooks apply side effects of committed transaction under dataMtx
+	commit []func()
+
+	// staged records by key, nil record means removed record
+	staged map[string]*Record
+	// keys in order of first mutation
+	order []string
+
+	events []*pbCDC.ListenResponse
+}
+
+func newTx(ctx context.Context, data Backend, idempotencyRetention, retention time.Duration) *tx {
+	return &tx{
+		data:                 data,
+		idempotencyRetention: idempotencyRetention,
+		now:                  time.Now(),
+		user:                 userFromContext(ctx),
+		retention:            retention,
+		collection:           collectionFromContext(ctx),
+		staged:               make(map[string]*Record),
+	}
+}
+
+// get returns staged or stored record. Expired record and tombstone are not visible even if they are not removed yet
+func (t *tx) get(id string) (*Record, bool, error) {
+	r, ok, err := t.lookup(id)
+	if ok && r.deleted() {
+		return nil, false, nil
+	}
+	return r, ok, err
+}
+
+// lookup returns staged or stored record including tombstone
+func (t *tx) lookup(id string) (*Record, bool, error) {
+	key := t.key(id)
+	if err := t.lock(key); err != nil {
+		return nil, false, err
+	}
+	if r, ok := t.staged[key]; ok {
+		return r, r != nil, nil
+	}
+	r, ok, err := t.data.Get(key)
+	if err != nil {
+		return nil, false, status.Errorf(codes.Internal, err.Error())
+	}
+	if ok && r.expired(t.now) {
+		return nil, false, nil
+	}
+	return r, ok, nil
+}
+
+// key returns backend key of record of transaction collection. System ids are not scoped by collection
+func (t *tx) key(id string) string {
+	if isSystemID(id) {
+		return id
+	}
+	return recordKey(t.collection, id)
+}
+
+// lock locks stripe of backend key until end of transaction
+func (t *tx) lock(key string) error {
+	if t.locks == nil {
+		return nil
+	}
+	return t.locks.lock(key)
+}
+
+func (t *tx) put(id string, r *Record) {
+	t.putKey(t.key(id), r)
+}
+
+// putKey stages record by backend key. Key is locked by lookup or lock before
+func (t *tx) putKey(key string, r *Record) {
+	if _, ok := t.staged[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.staged[key] = r
+}
+
+func (t *tx) undo() {
+	for i := len(t.rollback) - 1; i >= 0; i-- {
+		t.rollback[i]()
+	}
+}
+
+func (t *tx) notify(event pbCDC.ListenResponse_EventType, data *pbCDC.Data) {
+	t.notifyIn(t.collection, event, data)
+}
+
+func (t *tx) notifyIn(collection string, event pbCDC.ListenResponse_EventType, data *pbCDC.Data) {
+	t.events = append(t.events, &pbCDC.ListenResponse{
+		Event:      event,
+		Data:       data,
+		Collection: collection,
+	})
+}
+
+func (t *tx) mutations() []Mutation {
+	mutations := make([]Mutation, 0, len(t.order))
+	for _, key := range t.order {
+		mutations = append(mutations, Mutation{ID: key, Record: t.staged[key]})
+	}
+	return mutations
+}
+
+func (t *tx) create(request *pbCRUD.CreateRequest) (id string, version uint64, err error) {
+	if key := request.GetIdempotencyKey(); key != "" {
+		// concurrent creates with same idempotency key are serialized by stripe of its record
+		result, ok, lookupErr := t.idempotencyResult(key)
+		if lookupErr != nil {
+			return "", 0, lookupErr
+		}
+		if ok {
+			return result.ID, result.Version, nil
+		}
+		defer func() {
+			if err == nil {
+				err = t.rememberResult(key, idempotencyResult{ID: id, Version: version})
+			}
+		}()
+	}
+
+	ttl := request.GetTtl()
+	if ttl == nil && t.settings != nil && t.settings.DefaultTTL > 0 {
+		ttl = durationpb.New(t.settings.DefaultTTL)
+	}
+	expiresAt, err := t.expiresAt(ttl, time.Time{})
+	if err != nil {
+		return "", 0, err
+	}
+	if err := t.validate(request.GetRaw()); err != nil {
+		return "", 0, err
+	}
+
+	id = request.GetId()
+	if id == "" {
+		// random id: time-based id takes global lock of clock sequence
+		uuid, err := uuid.NewRandom()
+		if err != nil {
+			return "", 0, status.Errorf(codes.Internal, err.Error())
+		}
+		id = uuid.String()
+		if err := t.lock(t.key(id)); err != nil {
+			return "", 0, err
+		}
+	} else {
+		if err := validateID(id); err != nil {
+			return "", 0, err
+		}
+		old, ok, err := t.lookup(id)
+		if err != nil {
+			return "", 0, err
+		}
+		if ok && !old.deleted() {
+			return "", 0, status.Errorf(codes.AlreadyExists, "record '%s' already exists", id)
+		}
+		if ok {
+			// versions of deleted record stay in history, so new record continues them
+			version = old.Version
+		}
+	}
+
+	r := &Record{
+		Raw:         request.GetRaw(),
+		Version:     version + 1,
+		ExpiresAt:   expiresAt,
+		ContentType: request.GetContentType(),
+		CreatedAt:   t.now,
+		UpdatedAt:   t.now,
+		CreatedBy:   t.user,
+		Size:        uint64(len(request.GetRaw())),
+	}
+	t.put(id, r)
+	t.notify(pbCDC.ListenResponse_Created, r.cdcData(id))
+
+	return id, r.Version, nil
+}
+
+func (t *tx) update(request *pbCRUD.UpdateRequest) (version uint64, err error) {
+	id := request.GetData().GetId()
+	if err := validateID(id); err != nil {
+		return 0, err
+	}
+	old, ok, err := t.get(id)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, status.Errorf(codes.NotFound, "")
+	}
+	if err := checkVersion(old, request.GetExpectedVersion()); err != nil {
+		return 0, err
+	}
+	if err := t.validate(request.GetData().GetRaw()); err != nil {
+		return 0, err
+	}
+	expiresAt, err := t.expiresAt(request.GetTtl(), old.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	contentType := request.GetContentType()
+	if contentType == "" {
+		contentType = old.ContentType
+	}
+
+	r := &Record{
+		Raw:         request.GetData().GetRaw(),
+		Version:     old.Version + 1,
+		ExpiresAt:   expiresAt,
+		ContentType: contentType,
+		CreatedAt:   old.CreatedAt,
+		UpdatedAt:   t.now,
+		CreatedBy:   old.CreatedBy,
+		Size:        uint64(len(request.GetData().GetRaw())),
+	}
+	t.put(id, r)
+	t.notify(pbCDC.ListenResponse_Updated, r.cdcData(id))
+
+	return r.Version, nil
+}
+
+// patch updates record by its JSON document changed by patch
+func (t *tx) patch(request *pbCRUD.PatchRequest) (version uint64, raw []byte, err error) {
+	id := request.GetId()
+	if err := validateID(id); err != nil {
+		return 0, nil, err
+	}
+	old, ok, err := t.get(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok {
+		return 0, nil, status.Errorf(codes.NotFound, "")
+	}
+	if err := checkVersion(old, request.GetExpectedVersion()); err != nil {
+		return 0, nil, err
+	}
+	raw, err = applyPatch(old.Raw, request.GetFormat(), request.GetPatch())
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err = t.update(&pbCRUD.UpdateRequest{
+		Data:            &pbCRUD.Data{Id: id, Raw: raw},
+		ExpectedVersion: old.Version,
+	})
+	return version, raw, err
+}
+
+// validate checks body of record against schema of collection
+func (t *tx) validate(raw []byte) error {
+	if t.settings == nil || t.settings.validator == nil {
+		return nil
+	}
+	if violations := t.settings.validator.validate(raw); len(violations) > 0 {
+		return schemaError(t.settings.Name, violations)
+	}
+	return nil
+}
+
+// upsert updates existing record or creates record with requested id
+func (t *tx) upsert(request *pbCRUD.UpsertRequest) (version uint64, created bool, err error) {
+	if err := validateID(request.GetData().GetId()); err != nil {
+		return 0, false, err
+	}
+	_, ok, err := t.get(request.GetData().GetId())
+	if err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		if request.GetExpectedVersion() != 0 {
+			return 0, false, status.Errorf(codes.NotFound, "")
+		}
+		_, version, err = t.create(&pbCRUD.CreateRequest{
+			Raw:         request.GetData().GetRaw(),
+			Ttl:         request.GetTtl(),
+			ContentType: request.GetContentType(),
+			Id:          request.GetData().GetId(),
+		})
+		return version, true, err
+	}
+	version, err = t.update(&pbCRUD.UpdateRequest{
+		Data:            request.GetData(),
+		ExpectedVersion: request.GetExpectedVersion(),
+		Ttl:             request.GetTtl(),
+		ContentType:     request.GetContentType(),
+	})
+	return version, false, err
+}
+
+func (t *tx) delete(request *pbCRUD.DeleteRequest) error {
+	id := request.GetId()
+	if err := validateID(id); err != nil {
+		return err
+	}
+	r, ok, err := t.get(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if request.GetExpectedVersion() != 0 {
+			return status.Errorf(codes.NotFound, "")
+		}
+		// delete of not existing record is not an error
+		return nil
+	}
+	if err := checkVersion(r, request.GetExpectedVersion()); err != nil {
+		return err
+	}
+
+	if t.retention <= 0 {
+		t.put(id, nil)
+		t.notify(pbCDC.ListenResponse_Deleted, &pbCDC.Data{
+			Id: id,
+		})
+		return nil
+	}
+
+	tombstone := *r
+	tombstone.Version = r.Version + 1
+	tombstone.UpdatedAt = t.now
+	tombstone.DeletedAt = t.now
+	t.put(id, &tombstone)
+	t.notify(pbCDC.ListenResponse_Deleted, &pbCDC.Data{
+		Id:      id,
+		Version: tombstone.Version,
+	})
+
+	return nil
+}
+
+// undelete restores tombstone of deleted record
+func (t *tx) undelete(request *pbCRUD.UndeleteRequest) (version uint64, err error) {
+	id := request.GetId()
+	if err := validateID(id); err != nil {
+		return 0, err
+	}
+	r, ok, err := t.lookup(id)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, status.Errorf(codes.NotFound, "")
+	}
+	if !r.deleted() {
+		return 0, status.Errorf(codes.FailedPrecondition, "record '%s' is not deleted", id)
+	}
+
+	restored := *r
+	restored.Version = r.Version + 1
+	restored.UpdatedAt = t.now
+	restored.DeletedAt = time.Time{}
+	t.put(id, &restored)
+	t.notify(pbCDC.ListenResponse_Undeleted, restored.cdcData(id))
+
+	return restored.Version, nil
+}
+
+// purge removes tombstone of deleted record permanently
+func (t *tx) purge(request *pbCRUD.PurgeRequest) error {
+	id := request.GetId()
+	if err := validateID(id); err != nil {
+		return err
+	}
+	r, ok, err := t.lookup(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return status.Errorf(codes.NotFound, "")
+	}
+	if !r.deleted() {
+		return status.Errorf(codes.FailedPrecondition, "record '%s' is not deleted", id)
+	}
+
+	t.put(id, nil)
+	t.notify(pbCDC.ListenResponse_Purged, &pbCDC.Data{
+		Id: id,
+	})
+
+	return nil
+}
+
+// expire removes record by backend key if it still expires at expiresAt: record may be updated after expiration was scheduled
+func (t *tx) expire(key string, expiresAt time.Time) error {
+	if err := t.lock(key); err != nil {
+		return err
+	}
+	r, ok, err := t.data.Get(key)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	if !ok || !r.ExpiresAt.Equal(expiresAt) {
+		return nil
+	}
+
+	event := pbCDC.ListenResponse_Deleted
+	if r.deleted() {
+		event = pbCDC.ListenResponse_Purged
+	}
+	t.putKey(key, nil)
+	if isSystemID(key) {
+		// expired system records are not visible to listeners
+		return nil
+	}
+	collection, id := splitKey(key)
+	t.events = append(t.events, &pbCDC.ListenResponse{
+		Event:      event,
+		Data:       &pbCDC.Data{Id: id},
+		Reason:     pbCDC.ListenResponse_Expired,
+		Collection: collection,
+	})
+
+	return nil
+}
+
+// purgeTombstone removes tombstone by backend key if record is still deleted at deletedAt: record may be undeleted
+// or recreated after purge was scheduled
+func (t *tx) purgeTombstone(key string, deletedAt time.Time) error {
+	if err := t.lock(key); err != nil {
+		return err
+	}
+	r, ok, err := t.data.Get(key)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+	if !ok || !r.DeletedAt.Equal(deletedAt) {
+		return nil
+	}
+
+	collection, id := splitKey(key)
+	t.putKey(key, nil)
+	t.events = append(t.events, &pbCDC.ListenResponse{
+		Event:      pbCDC.ListenResponse_Purged,
+		Data:       &pbCDC.Data{Id: id},
+		Reason:     pbCDC.ListenResponse_RetentionElapsed,
+		Collection: collection,
+	})
+
+	return nil
+}
+
+// expiresAt converts requested time to live into expiration time.
+// Unset ttl keeps current expiration, zero ttl means no expiration
+func (t *tx) expiresAt(ttl *durationpb.Duration, current time.Time) (time.Time, error) {
+	if ttl == nil {
+		return current, nil
+	}
+	if err := ttl.CheckValid(); err != nil {
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "wrong ttl: %s", err.Error())
+	}
+	d := ttl.AsDuration()
+	switch {
+	case d < 0:
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "negative ttl")
+	case d == 0:
+		return time.Time{}, nil
+	default:
+		return t.now.Add(d), nil
+	}
+}
+
+const maxIDLength = 256
+
+// systemIDPrefix is a prefix of ids of system records. System records are not visible to CRUD requests
+const systemIDPrefix = "\x00"
+
+func isSystemID(id string) bool {
+	return strings.HasPrefix(id, systemIDPrefix)
+}
+
+// isReservedID is true for ids of system records and keys of records of named collections
+func isReservedID(id string) bool {
+	return isSystemID(id) || strings.HasPrefix(id, collectionKeyPrefix)
+}
+
+// validateID checks id of CRUD request
+func validateID(id string) error {
+	switch {
+	case id == "":
+		return status.Errorf(codes.InvalidArgument, "empty id")
+	case isReservedID(id):
+		return status.Errorf(codes.InvalidArgument, "id is reserved")
+	case len(id) > maxIDLength:
+		return status.Errorf(codes.InvalidArgument, "id is longer than %d bytes", maxIDLength)
+	case !utf8.ValidString(id):
+		return status.Errorf(codes.InvalidArgument, "id is not valid UTF-8")
+	}
+	return nil
+}
+
+// checkVersion validates expected version precondition. Zero expected version means no precondition
+func checkVersion(r *Record, expectedVersion uint64) error {
+	if expectedVersion != 0 && r.Version != expectedVersion {
+		return status.Errorf(codes.FailedPrecondition, "version mismatch: expected %d, actual %d", expectedVersion, r.Version)
+	}
+	return nil
+}
+
+// apply runs batch operation
+func (t *tx) apply(op *pbCRUD.Operation) (*pbCRUD.OperationResult, error) {
+	switch op := op.GetOp().(type) {
+	case *pbCRUD.Operation_Create:
+		id, version, err := t.create(op.Create)
+		if err != nil {
+			return nil, err
+		}
+		return &pbCRUD.OperationResult{Id: id, Version: version}, nil
+	case *pbCRUD.Operation_Update:
+		version, err := t.update(op.Update)
+		if err != nil {
+			return nil, err
+		}
+		return &pbCRUD.OperationResult{Id: op.Update.GetData().GetId(), Version: version}, nil
+	case *pbCRUD.Operation_Upsert:
+		version, _, err := t.upsert(op.Upsert)
+		if err != nil {
+			return nil, err
+		}
+		return &pbCRUD.OperationResult{Id: op.Upsert.GetData().GetId(), Version: version}, nil
+	case *pbCRUD.Operation_Delete:
+		if err := t.delete(op.Delete); err != nil {
+			return nil, err
+		}
+		return &pbCRUD.OperationResult{Id: op.Delete.GetId()}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "empty operation")
+	}
+}
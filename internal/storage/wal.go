@@ -0,0 +1,581 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SyncPolicy defines when write-ahead log is flushed to stable storage
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs log on every write before write is acknowledged
+	SyncAlways = SyncPolicy("always")
+	// SyncBatch syncs log periodically. Writes acknowledged since last sync may be lost on power failure
+	SyncBatch = SyncPolicy("batch")
+	// SyncNone leaves flushing to operating system
+	SyncNone = SyncPolicy("none")
+)
+
+const (
+	walSegmentPrefix  = "wal-"
+	walSegmentExt     = ".log"
+	walSnapshotPrefix = "snapshot-"
+	walSnapshotExt    = ".snap"
+
+	walOpPut    = "put"
+	walOpDelete = "delete"
+	walOpBatch  = "batch"
+)
+
+var (
+	walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errWalCorrupted = errors.New("wal entry corrupted")
+)
+
+type walEntry struct {
+	LSN       uint64     `json:"lsn"`
+	Op        string     `json:"op,omitempty"`
+	ID        string     `json:"id,omitempty"`
+	Record    *Record    `json:"record,omitempty"`
+	Mutations []Mutation `json:"mutations,omitempty"`
+}
+
+func walEntryOf(mutations []Mutation) *walEntry {
+	if len(mutations) > 1 {
+		return &walEntry{Op: walOpBatch, Mutations: mutations}
+	}
+	if m := mutations[0]; m.Record != nil {
+		return &walEntry{Op: walOpPut, ID: m.ID, Record: m.Record}
+	}
+	return &walEntry{Op: walOpDelete, ID: mutations[0].ID}
+}
+
+// WalOptions configures write-ahead log backend
+type WalOptions struct {
+	// Sync is a fsync policy of log
+	Sync SyncPolicy
+	// SyncInterval is a period of log fsync for SyncBatch policy
+	SyncInterval time.Duration
+	// SnapshotEvery is a count of log entries which triggers snapshot and log compaction
+	SnapshotEvery int
+}
+
+// walBackend keeps records in memory and appends every mutation to write-ahead log.
+// Log is split into segments named by first LSN. Snapshot of all records is taken
+// in background every SnapshotEvery entries, after that covered segments are removed
+type walBackend struct {
+	dir  string
+	opts WalOptions
+
+	// guards data, it is changed under logMtx only
+	dataMtx sync.RWMutex
+	data    map[string]*Record
+
+	// guards log file and fields below: writes are appended and applied under it,
+	// sync and snapshot goroutines touch log concurrently
+	logMtx       sync.Mutex
+	log          *os.File
+	logBuf       *bufio.Writer
+	lsn          uint64
+	dirty        bool
+	sinceSnap    int
+	snapshotting bool
+	snapshotDone sync.WaitGroup
+	err          error
+
+	done chan struct{}
+}
+
+func walSegmentName(lsn uint64) string {
+	return fmt.Sprintf("%s%020d%s", walSegmentPrefix, lsn, walSegmentExt)
+}
+
+func walSnapshotName(lsn uint64) string {
+	return fmt.Sprintf("%s%020d%s", walSnapshotPrefix, lsn, walSnapshotExt)
+}
+
+func writeWalEntry(w io.Writer, e *walEntry) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCrcTable))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// readWalEntry returns entry with its encoded size. Error is io.EOF on clean end of stream
+// and errWalCorrupted on torn or damaged entry
+func readWalEntry(r io.Reader) (_ *walEntry, size int64, _ error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errWalCorrupted
+		}
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errWalCorrupted
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, walCrcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errWalCorrupted
+	}
+	var e walEntry
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, 0, errWalCorrupted
+	}
+	return &e, int64(len(header) + len(payload)), nil
+}
+
+func (b *walBackend) Get(id string) (*Record, bool, error) {
+	b.dataMtx.RLock()
+	defer b.dataMtx.RUnlock()
+
+	r, ok := b.data[id]
+	return r, ok, nil
+}
+
+// Apply writes all mutations as single log entry, so torn batch is never replayed partially.
+// Entry is applied to records under logMtx, so snapshot taken at LSN has all entries up to it
+func (b *walBackend) Apply(mutations ...Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	b.logMtx.Lock()
+	defer b.logMtx.Unlock()
+
+	if err := b.append(walEntryOf(mutations)); err != nil {
+		return err
+	}
+	b.apply(mutations)
+	b.maybeSnapshot()
+	return nil
+}
+
+func (b *walBackend) apply(mutations []Mutation) {
+	b.dataMtx.Lock()
+	defer b.dataMtx.Unlock()
+
+	for _, m := range mutations {
+		if m.Record == nil {
+			delete(b.data, m.ID)
+		} else {
+			b.data[m.ID] = m.Record
+		}
+	}
+}
+
+func (b *walBackend) Keys() ([]string, error) {
+	b.dataMtx.RLock()
+	defer b.dataMtx.RUnlock()
+
+	ids := make([]string, 0, len(b.data))
+	for id := range b.data {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// append writes entry to log. Caller holds logMtx
+func (b *walBackend) append(e *walEntry) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	e.LSN = b.lsn + 1
+	if err := writeWalEntry(b.logBuf, e); err != nil {
+		return b.fail(err)
+	}
+	if err := b.logBuf.Flush(); err != nil {
+		return b.fail(err)
+	}
+	if b.opts.Sync == SyncAlways {
+		if err := b.log.Sync(); err != nil {
+			return b.fail(err)
+		}
+	} else {
+		b.dirty = true
+	}
+	b.lsn = e.LSN
+	b.sinceSnap++
+
+	return nil
+}
+
+// maybeSnapshot must be called after appended entry is applied to records. Caller holds logMtx.
+// Entry is already durable, so rotation failure breaks only subsequent writes
+func (b *walBackend) maybeSnapshot() {
+	if b.opts.SnapshotEvery > 0 && b.sinceSnap >= b.opts.SnapshotEvery && !b.snapshotting {
+		if err := b.startSnapshot(); err != nil {
+			_ = b.fail(err)
+		}
+	}
+}
+
+// fail makes backend read-only: log tail state is unknown after failed write
+func (b *walBackend) fail(err error) error {
+	b.err = fmt.Errorf("wal is broken: %w", err)
+	log.Error().Caller().Err(err).Msg("wal write failed, backend switched to read-only")
+	return b.err
+}
+
+// startSnapshot rotates log segment and writes snapshot of current records in background.
+// Records are never modified in place, so shallow copy of map is a consistent view
+func (b *walBackend) startSnapshot() error {
+	if err := b.rotate(); err != nil {
+		return err
+	}
+
+	lsn := b.lsn
+	records := make(map[string]*Record, len(b.data))
+	for id, r := range b.data {
+		records[id] = r
+	}
+
+	b.sinceSnap = 0
+	b.snapshotting = true
+	b.snapshotDone.Add(1)
+	go func() {
+		defer b.snapshotDone.Done()
+		err := b.writeSnapshot(lsn, records)
+		if err != nil {
+			log.Error().Caller().Err(err).Uint64("lsn", lsn).Msg("snapshot failed")
+		} else {
+			log.Info().Caller().Uint64("lsn", lsn).Int("records", len(records)).Msg("snapshot done")
+		}
+		b.logMtx.Lock()
+		b.snapshotting = false
+		b.logMtx.Unlock()
+	}()
+
+	return nil
+}
+
+// rotate syncs and closes current segment and opens next one
+func (b *walBackend) rotate() error {
+	if err := b.log.Sync(); err != nil {
+		return err
+	}
+	if err := b.log.Close(); err != nil {
+		return err
+	}
+	b.dirty = false
+	return b.openSegment(b.lsn + 1)
+}
+
+func (b *walBackend) openSegment(firstLSN uint64) error {
+	f, err := os.OpenFile(filepath.Join(b.dir, walSegmentName(firstLSN)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(b.dir); err != nil {
+		_ = f.Close()
+		return err
+	}
+	b.log = f
+	b.logBuf = bufio.NewWriter(f)
+	return nil
+}
+
+func (b *walBackend) writeSnapshot(lsn uint64, records map[string]*Record) error {
+	path := filepath.Join(b.dir, walSnapshotName(lsn))
+	f, err := os.CreateTemp(b.dir, walSnapshotName(lsn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := writeWalEntry(w, &walEntry{LSN: lsn}); err != nil {
+		return err
+	}
+	for id, r := range records {
+		if err := writeWalEntry(w, &walEntry{LSN: lsn, Op: walOpPut, ID: id, Record: r}); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(b.dir); err != nil {
+		return err
+	}
+
+	return b.compact(lsn)
+}
+
+// compact removes snapshots older than lsn and log segments fully covered by snapshot
+func (b *walBackend) compact(lsn uint64) error {
+	snapshots, segments, err := b.files()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s < lsn {
+			if err := os.Remove(filepath.Join(b.dir, walSnapshotName(s))); err != nil {
+				return err
+			}
+		}
+	}
+	// segment is covered if next segment starts not later than lsn+1
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i+1] <= lsn+1 {
+			if err := os.Remove(filepath.Join(b.dir, walSegmentName(segments[i]))); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(b.dir)
+}
+
+// files returns sorted LSNs of snapshots and log segments
+func (b *walBackend) files() (snapshots, segments []uint64, _ error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		var lsn uint64
+		name := e.Name()
+		switch {
+		case filepath.Ext(name) == walSnapshotExt:
+			if _, err := fmt.Sscanf(name, walSnapshotPrefix+"%d"+walSnapshotExt, &lsn); err == nil {
+				snapshots = append(snapshots, lsn)
+			}
+		case filepath.Ext(name) == walSegmentExt:
+			if _, err := fmt.Sscanf(name, walSegmentPrefix+"%d"+walSegmentExt, &lsn); err == nil {
+				segments = append(segments, lsn)
+			}
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return snapshots, segments, nil
+}
+
+// recover loads latest snapshot and replays log tail after it.
+// Torn entry at the end of last segment is a result of crash during unacknowledged write, so it is truncated
+func (b *walBackend) recover() error {
+	start := time.Now()
+
+	snapshots, segments, err := b.files()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Caller().Int("snapshots", len(snapshots)).Int("segments", len(segments)).Msg("wal recovery started")
+
+	if len(snapshots) > 0 {
+		lsn := snapshots[len(snapshots)-1]
+		if err := b.loadSnapshot(lsn); err != nil {
+			return fmt.Errorf("load snapshot %d: %w", lsn, err)
+		}
+		log.Info().Caller().Uint64("lsn", lsn).Int("records", len(b.data)).Msg("wal snapshot loaded")
+	}
+
+	for i, first := range segments {
+		last := i == len(segments)-1
+		if !last && segments[i+1] <= b.lsn+1 {
+			continue
+		}
+		if first > b.lsn+1 {
+			return fmt.Errorf("wal gap: segment %d starts after lsn %d", first, b.lsn)
+		}
+		replayed, err := b.replaySegment(first, last)
+		if err != nil {
+			return fmt.Errorf("replay segment %d: %w", first, err)
+		}
+		log.Info().Caller().Uint64("segment", first).Int("entries", replayed).Uint64("lsn", b.lsn).Msg("wal segment replayed")
+	}
+
+	log.Info().Caller().Uint64("lsn", b.lsn).Int("records", len(b.data)).Stringer("duration", time.Since(start)).Msg("wal recovery done")
+
+	return nil
+}
+
+func (b *walBackend) loadSnapshot(lsn uint64) error {
+	f, err := os.Open(filepath.Join(b.dir, walSnapshotName(lsn)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, _, err := readWalEntry(r)
+	if err != nil {
+		return err
+	}
+	for {
+		e, _, err := readWalEntry(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b.data[e.ID] = e.Record
+	}
+	b.lsn = header.LSN
+	return nil
+}
+
+func (b *walBackend) replaySegment(first uint64, last bool) (replayed int, _ error) {
+	path := filepath.Join(b.dir, walSegmentName(first))
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		e, size, err := readWalEntry(r)
+		if errors.Is(err, io.EOF) {
+			return replayed, nil
+		}
+		if errors.Is(err, errWalCorrupted) && last {
+			log.Warn().Caller().Uint64("segment", first).Int64("offset", offset).Msg("wal torn tail truncated")
+			return replayed, os.Truncate(path, offset)
+		}
+		if err != nil {
+			return replayed, err
+		}
+		offset += size
+		if e.LSN <= b.lsn {
+			continue
+		}
+		if e.LSN != b.lsn+1 {
+			return replayed, fmt.Errorf("wal gap: entry %d after lsn %d", e.LSN, b.lsn)
+		}
+		switch e.Op {
+		case walOpPut:
+			b.data[e.ID] = e.Record
+		case walOpDelete:
+			delete(b.data, e.ID)
+		case walOpBatch:
+			b.apply(e.Mutations)
+		default:
+			return replayed, fmt.Errorf("unknown wal operation '%s'", e.Op)
+		}
+		b.lsn = e.LSN
+		replayed++
+	}
+}
+
+func (b *walBackend) syncLoop() {
+	ticker := time.NewTicker(b.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.logMtx.Lock()
+			if b.dirty && b.err == nil {
+				if err := b.log.Sync(); err != nil {
+					_ = b.fail(err)
+				}
+				b.dirty = false
+			}
+			b.logMtx.Unlock()
+		}
+	}
+}
+
+func (b *walBackend) Close() error {
+	close(b.done)
+	b.snapshotDone.Wait()
+
+	b.logMtx.Lock()
+	defer b.logMtx.Unlock()
+
+	if err := b.log.Sync(); err != nil {
+		_ = b.log.Close()
+		return err
+	}
+	return b.log.Close()
+}
+
+// NewWalBackend makes backend with write-ahead log in dir and recovers records from it
+func NewWalBackend(dir string, opts WalOptions) (*walBackend, error) {
+	switch opts.Sync {
+	case SyncAlways, SyncNone:
+	case SyncBatch:
+		if opts.SyncInterval <= 0 {
+			return nil, fmt.Errorf("sync interval must be positive for '%s' policy", opts.Sync)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sync policy '%s'", opts.Sync)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tmp {
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &walBackend{
+		dir:  dir,
+		opts: opts,
+		data: make(map[string]*Record),
+		done: make(chan struct{}),
+	}
+
+	if err := b.recover(); err != nil {
+		return nil, err
+	}
+
+	// new segment per start keeps recovered segments immutable
+	if err := b.openSegment(b.lsn + 1); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncBatch {
+		go b.syncLoop()
+	}
+
+	return b, nil
+}
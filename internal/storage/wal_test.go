@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestWalRecoverTornTail(t *testing.T) {
+	// entry of crashed write which was never acknowledged
+	var entry bytes.Buffer
+	if err := writeWalEntry(&entry, &walEntry{LSN: 4, Op: walOpPut, ID: "d", Record: &Record{Raw: []byte("d")}}); err != nil {
+		t.Fatal(err)
+	}
+	damaged := append([]byte(nil), entry.Bytes()...)
+	damaged[len(damaged)-2] ^= 0xff
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{name: "clean"},
+		{name: "torn header", tail: entry.Bytes()[:3]},
+		{name: "torn payload", tail: entry.Bytes()[:entry.Len()-5]},
+		{name: "damaged checksum", tail: damaged},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b, err := NewWalBackend(dir, WalOptions{Sync: SyncAlways})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"a", "b", "c"} {
+				if err := b.Apply(Mutation{ID: id, Record: &Record{Raw: []byte(id)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			appendWalTail(t, dir, test.tail)
+
+			b, err = NewWalBackend(dir, WalOptions{Sync: SyncAlways})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWalKeys(t, b, "a", "b", "c")
+			// entries written after recovery follow the last whole entry, not the torn one
+			if err := b.Apply(Mutation{ID: "e", Record: &Record{Raw: []byte("e")}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err = NewWalBackend(dir, WalOptions{Sync: SyncAlways})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			checkWalKeys(t, b, "a", "b", "c", "e")
+		})
+	}
+}
+
+// appendWalTail appends bytes to the last log segment
+func appendWalTail(t *testing.T, dir string, tail []byte) {
+	segments, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"+walSegmentExt))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("no wal segments: %v", err)
+	}
+	sort.Strings(segments)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(tail); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkWalKeys(t *testing.T, b *walBackend, want ...string) {
+	t.Helper()
+	keys, err := b.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != len(want) {
+		t.Fatalf("keys %v, want %v", keys, want)
+	}
+	for i, key := range keys {
+		if key != want[i] {
+			t.Fatalf("keys %v, want %v", keys, want)
+		}
+		if r, ok, err := b.Get(key); err != nil || !ok || string(r.Raw) != key {
+			t.Fatalf("get '%s': %v, %v, %v", key, r, ok, err)
+		}
+	}
+}
@@ -2,11 +2,26 @@ package web
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pbAuth "github.com/amasynikov/grpc-webinar/internal/genproto/auth"
 	pbCRUD "github.com/amasynikov/grpc-webinar/internal/genproto/crud"
@@ -14,6 +29,145 @@ import (
 
 type ctxIkKey struct{}
 
+// ctxCollectionKey is a key of request context with name of collection from path prefix /collections/{collection}
+type ctxCollectionKey struct{}
+
+const uploadChunkSize = 64 << 10
+
+// quotaMaxObjectSize is a subject of storage-service quota violation of single record size
+const quotaMaxObjectSize = "max-object-size"
+
+// httpStatus maps error of storage-service to HTTP status code
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.InvalidArgument:
+		if len(fieldViolations(err)) > 0 {
+			return http.StatusUnprocessableEntity
+		}
+		return http.StatusBadRequest
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.ResourceExhausted:
+		for _, d := range status.Convert(err).Details() {
+			if q, ok := d.(*errdetails.QuotaFailure); ok {
+				for _, v := range q.GetViolations() {
+					if v.GetSubject() == quotaMaxObjectSize {
+						return http.StatusRequestEntityTooLarge
+					}
+				}
+			}
+		}
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// fieldViolations returns violations of schema of collection by record of storage-service error
+func fieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	for _, d := range status.Convert(err).Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			return br.GetFieldViolations()
+		}
+	}
+	return nil
+}
+
+type violation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// writeError writes error of storage-service, violations of schema are written as JSON
+func writeError(w http.ResponseWriter, err error) {
+	violations := fieldViolations(err)
+	if len(violations) == 0 {
+		w.WriteHeader(httpStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	body := struct {
+		Error      string      `json:"error"`
+		Violations []violation `json:"violations"`
+	}{Error: status.Convert(err).Message()}
+	for _, v := range violations {
+		body.Violations = append(body.Violations, violation{Field: v.GetField(), Description: v.GetDescription()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(err))
+	json.NewEncoder(w).Encode(body)
+}
+
+// patchFormat returns format of patch by content type of request
+func patchFormat(r *http.Request) (pbCRUD.PatchRequest_PatchFormat, error) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return 0, fmt.Errorf("wrong content type: %s", err.Error())
+	}
+	switch contentType {
+	case "application/json-patch+json":
+		return pbCRUD.PatchRequest_JsonPatch, nil
+	case "application/merge-patch+json":
+		return pbCRUD.PatchRequest_MergePatch, nil
+	default:
+		return 0, fmt.Errorf("content type '%s' is not a patch, expected application/json-patch+json or application/merge-patch+json", contentType)
+	}
+}
+
+// parseTTL parses optional time to live header of request
+func parseTTL(r *http.Request) (*durationpb.Duration, error) {
+	h := r.Header.Get("ttl")
+	if h == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(h)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "wrong ttl header '%s'", h)
+	}
+	return durationpb.New(d), nil
+}
+
+// etag makes strong entity tag from record version
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// ifMatch parses If-Match header into expected record version.
+// Missing header and "*" mean no precondition
+func ifMatch(r *http.Request) (uint64, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return 0, nil
+	}
+	version, err := strconv.ParseUint(strings.Trim(h, `"`), 10, 64)
+	if err != nil || version == 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "wrong If-Match header '%s'", h)
+	}
+	return version, nil
+}
+
+// setReadHeaders sets response headers by record metadata
+func setReadHeaders(w http.ResponseWriter, r *pbCRUD.ReadResponse) {
+	w.Header().Set("ETag", etag(r.GetVersion()))
+	contentType := r.GetMetadata().GetContentType()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if updatedAt := r.GetMetadata().GetUpdatedAt(); updatedAt != nil {
+		w.Header().Set("Last-Modified", updatedAt.AsTime().UTC().Format(http.TimeFormat))
+	}
+	if r.GetTtl() != nil {
+		w.Header().Set("ttl", r.GetTtl().AsDuration().String())
+	}
+}
+
 type httpSever struct {
 	auth    pbAuth.AuthClient
 	storage pbCRUD.CRUDClient
@@ -60,7 +214,7 @@ func (s httpSever) Run(ctx context.Context, port int) {
 		w.Write([]byte(loginOk.GetToken()))
 	})).Methods(http.MethodPost)
 
-	routes := root.NewRoute().Subrouter()
+	routes := mux.NewRouter()
 
 	routes.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -76,85 +230,504 @@ func (s httpSever) Run(ctx context.Context, port int) {
 				return
 			}
 			id := mux.Vars(r)["id"]
+			kv := []string{"user", user}
+			if collection, _ := r.Context().Value(ctxCollectionKey{}).(string); collection != "" {
+				kv = append(kv, "collection", collection)
+			}
 			next.ServeHTTP(
 				w,
 				r.WithContext(
-					context.WithValue(
-						r.Context(),
-						ctxIkKey{},
-						id,
+					metadata.AppendToOutgoingContext(
+						context.WithValue(
+							r.Context(),
+							ctxIkKey{},
+							id,
+						),
+						kv...,
 					),
 				),
 			)
 		})
 	})
 
-	routes.Handle("/create", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	create := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
 		body, err := io.ReadAll(request.Body)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			writer.Write([]byte(err.Error()))
 			return
 		}
+		ttl, err := parseTTL(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
 		createOk, err := s.storage.Create(request.Context(), &pbCRUD.CreateRequest{
-			Raw: body,
+			Raw:            body,
+			Ttl:            ttl,
+			ContentType:    request.Header.Get("Content-Type"),
+			Id:             id,
+			IdempotencyKey: request.Header.Get("Idempotency-Key"),
 		})
 		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			writer.Write([]byte(err.Error()))
+			writeError(writer, err)
 			return
 		}
+		writer.Header().Set("ETag", etag(createOk.GetVersion()))
 		writer.WriteHeader(http.StatusOK)
 		writer.Write([]byte(createOk.GetId()))
+	})
+
+	routes.Handle("/create", create).Methods(http.MethodPut)
+	routes.Handle("/create/{id}", create).Methods(http.MethodPut)
+
+	routes.Handle("/upsert/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		expectedVersion, err := ifMatch(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		ttl, err := parseTTL(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		upsertOk, err := s.storage.Upsert(request.Context(), &pbCRUD.UpsertRequest{
+			Data: &pbCRUD.Data{
+				Id:  id,
+				Raw: body,
+			},
+			ExpectedVersion: expectedVersion,
+			Ttl:             ttl,
+			ContentType:     request.Header.Get("Content-Type"),
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", etag(upsertOk.GetVersion()))
+		if upsertOk.GetCreated() {
+			writer.WriteHeader(http.StatusCreated)
+		} else {
+			writer.WriteHeader(http.StatusOK)
+		}
 	})).Methods(http.MethodPut)
 
+	upload := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		ttl, err := parseTTL(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		ctx, cancel := context.WithCancel(request.Context())
+		defer cancel()
+		stream, err := s.storage.Upload(ctx)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		// io.EOF of Send means that server closed stream, real error is returned by CloseAndRecv
+		err = stream.Send(&pbCRUD.UploadRequest{
+			Part: &pbCRUD.UploadRequest_Header{
+				Header: &pbCRUD.CreateRequest{
+					Ttl:            ttl,
+					ContentType:    request.Header.Get("Content-Type"),
+					Id:             id,
+					IdempotencyKey: request.Header.Get("Idempotency-Key"),
+				},
+			},
+		})
+		chunk := make([]byte, uploadChunkSize)
+		for err == nil {
+			n, readErr := io.ReadFull(request.Body, chunk)
+			if n > 0 {
+				err = stream.Send(&pbCRUD.UploadRequest{
+					Part: &pbCRUD.UploadRequest_Chunk{Chunk: chunk[:n]},
+				})
+			}
+			if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+				break
+			}
+			if readErr != nil {
+				// cancel stream, so partial body is not stored
+				cancel()
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(readErr.Error()))
+				return
+			}
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeError(writer, err)
+			return
+		}
+		uploadOk, err := stream.CloseAndRecv()
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", etag(uploadOk.GetVersion()))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write([]byte(uploadOk.GetId()))
+	})
+
+	routes.Handle("/upload", upload).Methods(http.MethodPut)
+	routes.Handle("/upload/{id}", upload).Methods(http.MethodPut)
+
+	routes.Handle("/download/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		stream, err := s.storage.Download(request.Context(), &pbCRUD.DownloadRequest{Id: id})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		first, err := stream.Recv()
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		setReadHeaders(writer, first.GetHeader())
+		writer.Header().Set("Content-Length", strconv.FormatUint(first.GetHeader().GetMetadata().GetSize(), 10))
+		writer.WriteHeader(http.StatusOK)
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				// status is already sent, so client sees truncated body only
+				log.Error().Caller().Str("id", id).Err(err).Msg("download interrupted")
+				return
+			}
+			if _, err := writer.Write(msg.GetChunk()); err != nil {
+				log.Error().Caller().Str("id", id).Err(err).Msg("download interrupted")
+				return
+			}
+		}
+	})).Methods(http.MethodGet)
+
 	routes.Handle("/read/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		id := request.Context().Value(ctxIkKey{}).(string)
-		readOk, err := s.storage.Read(request.Context(), &pbCRUD.ReadRequest{Id: id})
+		readRequest := &pbCRUD.ReadRequest{Id: id}
+		if v := request.URL.Query().Get("at"); v != "" {
+			at, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+			readRequest.At = timestamppb.New(at)
+		}
+		readOk, err := s.storage.Read(request.Context(), readRequest)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		setReadHeaders(writer, readOk)
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(readOk.GetRaw())
+	})).Methods(http.MethodGet)
+
+	routes.Handle("/read/{id}/versions", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		versionsOk, err := s.storage.ListVersions(request.Context(), &pbCRUD.ListVersionsRequest{Id: id})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := protojson.Marshal(versionsOk)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			writer.Write([]byte(err.Error()))
 			return
 		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	})).Methods(http.MethodGet)
+
+	routes.Handle("/read/{id}/versions/{version}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		version, err := strconv.ParseUint(mux.Vars(request)["version"], 10, 64)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		readOk, err := s.storage.ReadVersion(request.Context(), &pbCRUD.ReadVersionRequest{Id: id, Version: version})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		setReadHeaders(writer, readOk)
 		writer.WriteHeader(http.StatusOK)
 		writer.Write(readOk.GetRaw())
 	})).Methods(http.MethodGet)
 
 	routes.Handle("/update/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		id := request.Context().Value(ctxIkKey{}).(string)
+		expectedVersion, err := ifMatch(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		ttl, err := parseTTL(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
 		body, err := io.ReadAll(request.Body)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			writer.Write([]byte(err.Error()))
 			return
 		}
-		_, err = s.storage.Update(request.Context(), &pbCRUD.UpdateRequest{
+		updateOk, err := s.storage.Update(request.Context(), &pbCRUD.UpdateRequest{
 			Data: &pbCRUD.Data{
 				Id:  id,
 				Raw: body,
 			},
+			ExpectedVersion: expectedVersion,
+			Ttl:             ttl,
+			ContentType:     request.Header.Get("Content-Type"),
 		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", etag(updateOk.GetVersion()))
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodPost)
+
+	routes.Handle("/update/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		format, err := patchFormat(request)
+		if err != nil {
+			writer.Header().Set("Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		expectedVersion, err := ifMatch(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := io.ReadAll(request.Body)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			writer.Write([]byte(err.Error()))
 			return
 		}
+		patchOk, err := s.storage.Patch(request.Context(), &pbCRUD.PatchRequest{
+			Id:              id,
+			Format:          format,
+			Patch:           body,
+			ExpectedVersion: expectedVersion,
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", etag(patchOk.GetVersion()))
+		writer.Header().Set("Content-Type", "application/json")
 		writer.WriteHeader(http.StatusOK)
-	})).Methods(http.MethodPost)
+		writer.Write(patchOk.GetRaw())
+	})).Methods(http.MethodPatch)
 
 	routes.Handle("/delete/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		id := request.Context().Value(ctxIkKey{}).(string)
-		_, err := s.storage.Delete(request.Context(), &pbCRUD.DeleteRequest{
+		expectedVersion, err := ifMatch(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		_, err = s.storage.Delete(request.Context(), &pbCRUD.DeleteRequest{
+			Id:              id,
+			ExpectedVersion: expectedVersion,
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodDelete)
+
+	routes.Handle("/undelete/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		undeleteOk, err := s.storage.Undelete(request.Context(), &pbCRUD.UndeleteRequest{
+			Id: id,
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.Header().Set("ETag", etag(undeleteOk.GetVersion()))
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodPost)
+
+	routes.Handle("/purge/{id}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Context().Value(ctxIkKey{}).(string)
+		_, err := s.storage.Purge(request.Context(), &pbCRUD.PurgeRequest{
 			Id: id,
 		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodDelete)
+
+	routes.Handle("/usage", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		usageOk, err := s.storage.GetUsage(request.Context(), &pbCRUD.GetUsageRequest{})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := protojson.Marshal(usageOk)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	})).Methods(http.MethodGet)
+
+	routes.Handle("/list", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		var pageSize uint64
+		if v := query.Get("page_size"); v != "" {
+			var err error
+			pageSize, err = strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+		}
+		listOk, err := s.storage.List(request.Context(), &pbCRUD.ListRequest{
+			PageSize:  uint32(pageSize),
+			PageToken: query.Get("page_token"),
+			Prefix:    query.Get("prefix"),
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := protojson.Marshal(listOk)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			writer.Write([]byte(err.Error()))
 			return
 		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	})).Methods(http.MethodGet)
+
+	routes.Handle("/collections", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		collectionsOk, err := s.storage.ListCollections(request.Context(), &pbCRUD.ListCollectionsRequest{})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		body, err := protojson.Marshal(collectionsOk)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	})).Methods(http.MethodGet)
+
+	routes.Handle("/collections/{collection}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		collection := &pbCRUD.Collection{}
+		if len(body) > 0 {
+			if err := protojson.Unmarshal(body, collection); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+		}
+		collection.Name = mux.Vars(request)["collection"]
+		_, err = s.storage.CreateCollection(request.Context(), &pbCRUD.CreateCollectionRequest{
+			Collection: collection,
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodPut)
+
+	routes.Handle("/collections/{collection}", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, err := s.storage.DropCollection(request.Context(), &pbCRUD.DropCollectionRequest{
+			Name: mux.Vars(request)["collection"],
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
 		writer.WriteHeader(http.StatusOK)
 	})).Methods(http.MethodDelete)
 
+	// schema of collection is a request body, empty body removes schema
+	routes.Handle("/schema", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+		var schema *structpb.Struct
+		if len(body) > 0 {
+			schema = &structpb.Struct{}
+			if err := protojson.Unmarshal(body, schema); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(err.Error()))
+				return
+			}
+		}
+		collection, _ := request.Context().Value(ctxCollectionKey{}).(string)
+		_, err = s.storage.SetSchema(request.Context(), &pbCRUD.SetSchemaRequest{
+			Collection: collection,
+			Schema:     schema,
+		})
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})).Methods(http.MethodPut)
+
+	// routes under /collections/{collection}/ are routes of default collection scoped to the collection
+	root.PathPrefix("/collections/{collection}/").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collection := mux.Vars(r)["collection"]
+		scoped := r.Clone(context.WithValue(r.Context(), ctxCollectionKey{}, collection))
+		scoped.URL.Path = strings.TrimPrefix(r.URL.Path, "/collections/"+collection)
+		scoped.URL.RawPath = ""
+		routes.ServeHTTP(w, scoped)
+	}))
+	root.PathPrefix("/").Handler(routes)
+
 	if err := http.ListenAndServe(":"+strconv.Itoa(port), root); err != nil {
 		log.Fatal().Caller().Err(err).Msg("")
 	}